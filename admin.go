@@ -0,0 +1,64 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+)
+
+// AdminSecretHeader is the request header with Options.AdminSecret for admin requests,
+// such as the quota API and PURGE. It's never sent upstream.
+const AdminSecretHeader = "X-Smallprox-Admin"
+
+// isAdmin returns true if the request has the admin secret.
+func (proxy *Proxy) isAdmin(req *http.Request) bool {
+	proxy.mx.RLock()
+	secret := proxy.opts.AdminSecret
+	proxy.mx.RUnlock()
+	return secret != "" &&
+		subtle.ConstantTimeCompare([]byte(req.Header.Get(AdminSecretHeader)), []byte(secret)) == 1
+}
+
+// isOwnAddr returns true if addr is a listen address of the proxy.
+// Requests proxied to itself would come from the proxy host.
+func (proxy *Proxy) isOwnAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	proxy.mx.RLock()
+	listenAddrs := proxy.listenAddrs
+	proxy.mx.RUnlock()
+	for _, ln := range listenAddrs {
+		if ln.Port != tcpAddr.Port {
+			continue
+		}
+		if ln.IP.Equal(tcpAddr.IP) || (ln.IP.IsUnspecified() && isLocalIP(tcpAddr.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP returns true if ip is of this host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
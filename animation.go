@@ -0,0 +1,419 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// AnimationMode is what ImageShrinkResponder does with animated GIF and WebP images.
+type AnimationMode int32
+
+const (
+	AnimationPass     AnimationMode = iota // Leave animated images as is.
+	AnimationStill                         // Keep the first frame as a still image.
+	AnimationReencode                      // Fewer frames and a smaller size, as animated WebP or GIF.
+)
+
+func (mode AnimationMode) String() string {
+	switch mode {
+	case AnimationPass:
+		return "pass"
+	case AnimationStill:
+		return "still"
+	case AnimationReencode:
+		return "reencode"
+	}
+	return fmt.Sprintf("AnimationMode(%d)", int32(mode))
+}
+
+// ParseAnimationMode parses pass, still or reencode.
+func ParseAnimationMode(s string) (AnimationMode, error) {
+	for _, mode := range []AnimationMode{AnimationPass, AnimationStill, AnimationReencode} {
+		if strings.EqualFold(s, mode.String()) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown animation mode %q, expected pass, still or reencode", s)
+}
+
+// isAnimated returns true if data is a GIF or WebP with more than one frame, without decoding it.
+func isAnimated(data []byte) bool {
+	return isAnimatedGIF(data) || isAnimatedWebP(data)
+}
+
+func isAnimatedGIF(data []byte) bool {
+	_, frames := gifFrames(data)
+	return frames > 1
+}
+
+// gifFrames returns the size and number of frames of a GIF, without decoding it.
+func gifFrames(data []byte) (size image.Point, frames int) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return image.Point{}, 0
+	}
+	size = image.Pt(int(binary.LittleEndian.Uint16(data[6:])), int(binary.LittleEndian.Uint16(data[8:])))
+	i := 13
+	if data[10]&0x80 != 0 { // Global color table.
+		i += 3 << (data[10]&7 + 1)
+	}
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension introducer and label.
+			i += 2
+		case 0x2c: // Image descriptor.
+			if i+10 > len(data) {
+				return size, frames
+			}
+			frames++
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 { // Local color table.
+				i += 3 << (flags&7 + 1)
+			}
+			i++ // LZW minimum code size.
+		default: // Trailer.
+			return size, frames
+		}
+		// Skip the data sub-blocks.
+		for i < len(data) && data[i] != 0 {
+			i += int(data[i]) + 1
+		}
+		i++
+	}
+	return size, frames
+}
+
+func isAnimatedWebP(data []byte) bool {
+	return isWebP(data) && len(data) >= 21 && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// animation is a decoded animation of full frames.
+type animation struct {
+	frames []*image.NRGBA
+	delays []int // Milliseconds.
+	loops  int   // Times to play, 0 for forever.
+}
+
+// animationBuilder keeps at most maxFrames of n frames, scaled down to fit maxDim.
+// The delays of the dropped frames go to the kept frame before them.
+type animationBuilder struct {
+	ctx       context.Context
+	anim      animation
+	n, i      int
+	maxFrames int // 0 for all.
+	maxDim    int // 0 for no limit.
+}
+
+// add adds the next frame, returns false when no more frames are needed.
+func (ab *animationBuilder) add(canvas *image.NRGBA, delay int) bool {
+	slot := ab.i
+	if ab.maxFrames > 0 && ab.n > ab.maxFrames {
+		slot = ab.i * ab.maxFrames / ab.n
+	}
+	ab.i++
+	if slot < len(ab.anim.frames) {
+		ab.anim.delays[len(ab.anim.delays)-1] += delay
+	} else {
+		ab.anim.frames = append(ab.anim.frames, fitImage(canvas, ab.maxDim))
+		ab.anim.delays = append(ab.anim.delays, delay)
+	}
+	// A single frame is a still, its delay doesn't matter.
+	return ab.maxFrames != 1 && ab.ctx.Err() == nil
+}
+
+// maxAnimationPixels is the most pixels of all the frames of a GIF, or of a WebP canvas, to decode.
+// GIF frames are all decoded before any are dropped.
+const maxAnimationPixels = 64 << 20
+
+// errAnimationTooLarge is returned by decodeAnimation for animations over maxAnimationPixels.
+var errAnimationTooLarge = errors.New("animation too large to decode")
+
+// decodeAnimation decodes an animated GIF or WebP, keeping at most maxFrames frames scaled down to fit maxDim.
+// It stops early if ctx is done.
+func decodeAnimation(ctx context.Context, data []byte, maxFrames, maxDim int) (*animation, error) {
+	ab := &animationBuilder{ctx: ctx, maxFrames: maxFrames, maxDim: maxDim}
+	var err error
+	if isWebP(data) {
+		err = decodeAnimatedWebP(data, ab)
+	} else {
+		size, frames := gifFrames(data)
+		if int64(size.X)*int64(size.Y)*int64(frames) > maxAnimationPixels {
+			return nil, errAnimationTooLarge
+		}
+		err = decodeAnimatedGIF(data, ab)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ab.anim.frames) == 0 {
+		return nil, errors.New("animation has no frames")
+	}
+	return &ab.anim, nil
+}
+
+// frameDelay returns the delay browsers use, they show frames of 10ms or less for 100ms.
+func frameDelay(ms int) int {
+	if ms <= 10 {
+		return 100
+	}
+	return ms
+}
+
+func decodeAnimatedGIF(data []byte, ab *animationBuilder) error {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	ab.n = len(g.Image)
+	switch {
+	case g.LoopCount < 0:
+		ab.anim.loops = 1
+	case g.LoopCount > 0:
+		ab.anim.loops = g.LoopCount + 1
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var previous []byte
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		if !ab.add(canvas, frameDelay(g.Delay[i]*10)) {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return nil
+}
+
+func decodeAnimatedWebP(data []byte, ab *animationBuilder) error {
+	chunks, err := parseChunks(data[12:])
+	if err != nil {
+		return err
+	}
+	var canvas *image.NRGBA
+	var frames []riffChunk
+	for _, c := range chunks {
+		switch {
+		case c.id == "VP8X" && len(c.data) >= 10:
+			w, h := getUint24(c.data[4:])+1, getUint24(c.data[7:])+1
+			if int64(w)*int64(h) > maxAnimationPixels {
+				return errAnimationTooLarge
+			}
+			canvas = image.NewNRGBA(image.Rect(0, 0, w, h))
+		case c.id == "ANIM" && len(c.data) >= 6:
+			ab.anim.loops = int(binary.LittleEndian.Uint16(c.data[4:]))
+		case c.id == "ANMF":
+			if len(c.data) < 16 {
+				return errors.New("webp: bad ANMF chunk")
+			}
+			frames = append(frames, c)
+		}
+	}
+	if canvas == nil {
+		return errors.New("webp: missing VP8X chunk")
+	}
+	ab.n = len(frames)
+	for _, c := range frames {
+		x, y := 2*getUint24(c.data[0:]), 2*getUint24(c.data[3:])
+		r := image.Rect(x, y, x+getUint24(c.data[6:])+1, y+getUint24(c.data[9:])+1)
+		if !r.In(canvas.Rect) {
+			return errors.New("webp: frame outside the canvas")
+		}
+		still := stillWebP(c.data[16:], r.Dx(), r.Dy())
+		// The bitstream has its own size, which is what gets allocated.
+		if w, h, _, err := webp.GetInfo(still); err != nil {
+			return err
+		} else if w != r.Dx() || h != r.Dy() {
+			return errors.New("webp: frame size doesn't match its bitstream")
+		}
+		frame, err := webp.DecodeRGBA(still)
+		if err != nil {
+			return err
+		}
+		op := draw.Over
+		if c.data[15]&0x02 != 0 { // Do not blend.
+			op = draw.Src
+		}
+		draw.Draw(canvas, r, webpDecoded(frame), frame.Rect.Min, op)
+		if !ab.add(canvas, frameDelay(getUint24(c.data[12:]))) {
+			break
+		}
+		if c.data[15]&0x01 != 0 { // Dispose to the background.
+			draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return nil
+}
+
+// stillWebP returns a WebP file of the frame data of an ANMF chunk.
+func stillWebP(frameData []byte, w, h int) []byte {
+	body := []byte("WEBP")
+	if bytes.HasPrefix(frameData, []byte("ALPH")) {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10 // Alpha.
+		putUint24(vp8x[4:], w-1)
+		putUint24(vp8x[7:], h-1)
+		body = appendChunk(body, "VP8X", vp8x)
+	}
+	return appendChunk(nil, "RIFF", append(body, frameData...))
+}
+
+// encodeAnimatedWebP encodes anim as an animated WebP of full frames.
+func encodeAnimatedWebP(w io.Writer, anim *animation, quality int) error {
+	alpha := false
+	var frames []byte
+	for i, frame := range anim.frames {
+		frameAlpha := hasAlpha(frame)
+		alpha = alpha || frameAlpha
+		buf := &bytes.Buffer{}
+		if err := encodeWebP(buf, frame, quality, frameAlpha); err != nil {
+			return err
+		}
+		chunks, err := parseChunks(buf.Bytes()[12:])
+		if err != nil {
+			return err
+		}
+		anmf := make([]byte, 16)
+		putUint24(anmf[6:], frame.Rect.Dx()-1)
+		putUint24(anmf[9:], frame.Rect.Dy()-1)
+		putUint24(anmf[12:], anim.delays[i])
+		anmf[15] = 0x02 // Do not blend, the frames are full.
+		for _, c := range chunks {
+			if c.id != "VP8X" {
+				anmf = appendChunk(anmf, c.id, c.data)
+			}
+		}
+		frames = appendChunk(frames, "ANMF", anmf)
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 // Animation.
+	if alpha {
+		vp8x[0] |= 0x10
+	}
+	bounds := anim.frames[0].Rect
+	putUint24(vp8x[4:], bounds.Dx()-1)
+	putUint24(vp8x[7:], bounds.Dy()-1)
+	animChunk := make([]byte, 6) // Transparent background.
+	loops := anim.loops
+	if loops > 0xffff {
+		loops = 0
+	}
+	binary.LittleEndian.PutUint16(animChunk[4:], uint16(loops))
+	body := appendChunk([]byte("WEBP"), "VP8X", vp8x)
+	body = appendChunk(body, "ANIM", animChunk)
+	_, err := w.Write(appendChunk(nil, "RIFF", append(body, frames...)))
+	return err
+}
+
+// encodeAnimatedGIF encodes anim as an animated GIF of full frames.
+func encodeAnimatedGIF(w io.Writer, anim *animation) error {
+	// GIF counts the repeats: 0 is forever, -1 is once.
+	g := &gif.GIF{LoopCount: anim.loops - 1}
+	switch anim.loops {
+	case 0:
+		g.LoopCount = 0
+	case 1:
+		g.LoopCount = -1
+	}
+	disposal := byte(gif.DisposalNone)
+	for _, frame := range anim.frames {
+		if hasAlpha(frame) {
+			disposal = gif.DisposalBackground // Clear, or transparent areas would show the previous frame.
+			break
+		}
+	}
+	for i, frame := range anim.frames {
+		// GIF transparency is on or off.
+		for j := 3; j < len(frame.Pix); j += 4 {
+			if frame.Pix[j] < 128 {
+				frame.Pix[j] = 0
+			} else {
+				frame.Pix[j] = 255
+			}
+		}
+		g.Image = append(g.Image, quantize(frame))
+		g.Delay = append(g.Delay, (anim.delays[i]+5)/10)
+		g.Disposal = append(g.Disposal, disposal)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// fitImage returns a copy of img scaled down to fit maxDim, 0 for no limit.
+func fitImage(img *image.NRGBA, maxDim int) *image.NRGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	switch {
+	case maxDim <= 0 || (w <= maxDim && h <= maxDim):
+		return imaging.Clone(img)
+	case w > h:
+		return imaging.Resize(img, maxDim, 0, imaging.Lanczos)
+	default:
+		return imaging.Resize(img, 0, maxDim, imaging.Lanczos)
+	}
+}
+
+// riffChunk is a chunk of a RIFF file such as WebP.
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+func parseChunks(data []byte) ([]riffChunk, error) {
+	var chunks []riffChunk
+	for len(data) >= 8 {
+		size := binary.LittleEndian.Uint32(data[4:])
+		if uint64(size) > uint64(len(data)-8) {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		chunks = append(chunks, riffChunk{string(data[:4]), data[8 : 8+size]})
+		data = data[8+size:]
+		if size%2 == 1 && len(data) > 0 {
+			data = data[1:] // Padding.
+		}
+	}
+	return chunks, nil
+}
+
+func appendChunk(buf []byte, id string, data []byte) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	buf = append(append(append(buf, id...), size[:]...), data...)
+	if len(data)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func getUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,261 @@
+package smallprox
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// testGIF returns an animation of a square moving over an opaque or transparent background.
+func testGIF(t *testing.T, frames int, transparent bool) []byte {
+	palette := color.Palette{color.NRGBA{0, 0, 255, 255}, color.NRGBA{255, 0, 0, 255}}
+	if transparent {
+		palette[0] = color.NRGBA{}
+	}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 400, 200), palette)
+		for y := 50; y < 150; y++ {
+			for x := i * 20; x < i*20+100; x++ {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIsAnimated(t *testing.T) {
+	animGIF := testGIF(t, 10, false)
+	anim, err := decodeAnimation(context.Background(), animGIF, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	animWebP := &bytes.Buffer{}
+	if err := encodeAnimatedWebP(animWebP, anim, 50); err != nil {
+		t.Fatal(err)
+	}
+	stillWebP := &bytes.Buffer{}
+	if err := encodeWebP(stillWebP, anim.frames[0], 50, false); err != nil {
+		t.Fatal(err)
+	}
+	stillPNG := &bytes.Buffer{}
+	if err := png.Encode(stillPNG, anim.frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		animated bool
+	}{
+		{"animated gif", animGIF, true},
+		{"still gif", testGIF(t, 1, false), false},
+		{"animated webp", animWebP.Bytes(), true},
+		{"still webp", stillWebP.Bytes(), false},
+		{"png", stillPNG.Bytes(), false},
+		{"truncated gif", animGIF[:100], false},
+	} {
+		if got := isAnimated(tc.data); got != tc.animated {
+			t.Errorf("%s: expected animated %v, got %v", tc.name, tc.animated, got)
+		}
+	}
+}
+
+func TestDecodeAnimation(t *testing.T) {
+	data := testGIF(t, 10, true)
+	anim, err := decodeAnimation(context.Background(), data, 4, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.frames) != 4 {
+		t.Fatalf("Expected 4 frames, got %d", len(anim.frames))
+	}
+	total := 0
+	for _, delay := range anim.delays {
+		total += delay
+	}
+	if total != 1000 {
+		t.Errorf("Expected the total delay to stay 1000ms, got %d", total)
+	}
+	if size := anim.frames[0].Rect.Size(); size != image.Pt(200, 100) {
+		t.Errorf("Expected 200x100, got %v", size)
+	}
+
+	// Round trip through animated WebP.
+	buf := &bytes.Buffer{}
+	if err := encodeAnimatedWebP(buf, anim, 90); err != nil {
+		t.Fatal(err)
+	}
+	anim2, err := decodeAnimation(context.Background(), buf.Bytes(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim2.frames) != 4 || anim2.delays[1] != anim.delays[1] {
+		t.Fatalf("Expected 4 frames of %dms, got %d frames of %v", anim.delays[1], len(anim2.frames), anim2.delays)
+	}
+	for i, frame := range anim2.frames {
+		if c := frame.NRGBAAt(0, 0); c.A != 0 {
+			t.Errorf("Frame %d: expected a transparent background, got %v", i, c)
+		}
+		// Frames 0, 3, 5 and 8 are kept, the square moves 10px per frame when scaled.
+		x := (i*10+3)/4*10 + 25
+		if c := frame.NRGBAAt(x, 50); c.A != 255 || c.R < 200 {
+			t.Errorf("Frame %d: expected red at %d,50, got %v", i, x, c)
+		}
+	}
+}
+
+func TestImageShrinkAnimated(t *testing.T) {
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	data := testGIF(t, 20, false)
+	shrink := func(mode AnimationMode, accept string) (string, []byte) {
+		opts := DefaultImageShrinkOptions
+		opts.Animated = mode
+		opts.AnimatedMaxFrames = 5
+		opts.AnimatedMaxDimension = 100
+		er.SetOptions(opts)
+		resp := shrinkImage(er, "http://example.com/a.gif", accept, data)
+		out, _ := ioutil.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), out
+	}
+
+	if _, out := shrink(AnimationPass, "image/*"); !bytes.Equal(out, data) {
+		t.Error("Expected the original animation")
+	}
+
+	ct, out := shrink(AnimationStill, "image/webp,image/*")
+	if ct != "image/webp" || isAnimated(out) {
+		t.Errorf("Expected a still image/webp, got %s animated %v", ct, isAnimated(out))
+	}
+
+	// Animated WebP can't be decoded as a still.
+	anim, err := decodeAnimation(context.Background(), data, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := encodeAnimatedWebP(buf, anim, 100); err != nil {
+		t.Fatal(err)
+	}
+	data, gifData := buf.Bytes(), data
+	ct, out = shrink(AnimationStill, "image/*")
+	if ct != "image/jpeg" {
+		t.Errorf("Expected a still image/jpeg from animated WebP, got %s", ct)
+	}
+	data = gifData
+
+	for _, accept := range []string{"image/webp,image/*", "image/*"} {
+		ct, out = shrink(AnimationReencode, accept)
+		anim, err := decodeAnimation(context.Background(), out, 0, 0)
+		if err != nil {
+			t.Fatalf("%s: %s: %v", accept, ct, err)
+		}
+		if len(anim.frames) != 5 || anim.frames[0].Rect.Size() != image.Pt(100, 50) {
+			t.Errorf("%s: expected 5 frames of 100x50, got %d of %v", accept, len(anim.frames), anim.frames[0].Rect.Size())
+		}
+		if accept == "image/*" && ct != "image/gif" {
+			t.Errorf("Expected image/gif, got %s", ct)
+		}
+	}
+}
+
+func TestDecodeAnimationTooLarge(t *testing.T) {
+	palette := color.Palette{color.NRGBA{0, 0, 255, 255}, color.NRGBA{255, 0, 0, 255}}
+	g := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 8192, Height: 8192}}
+	for i := 0; i < 2; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(i, i, i+10, i+10), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if size, frames := gifFrames(data); size != image.Pt(8192, 8192) || frames != 2 {
+		t.Errorf("Expected 2 frames of 8192x8192, got %d of %v", frames, size)
+	}
+	if _, err := decodeAnimation(context.Background(), data, 0, 0); err != errAnimationTooLarge {
+		t.Errorf("Expected too large, got %v", err)
+	}
+
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	opts := DefaultImageShrinkOptions
+	opts.Animated = AnimationReencode
+	er.SetOptions(opts)
+	resp := shrinkImage(er, "http://example.com/a.gif", "image/*", data)
+	if out, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(out, data) || resp.StatusCode != 200 {
+		t.Errorf("Expected the original passed through, got %d", resp.StatusCode)
+	}
+}
+
+func TestAnimationLoops(t *testing.T) {
+	for _, loopCount := range []int{-1, 0, 3} {
+		g, err := gif.DecodeAll(bytes.NewReader(testGIF(t, 3, false)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.LoopCount = loopCount
+		buf := &bytes.Buffer{}
+		if err := gif.EncodeAll(buf, g); err != nil {
+			t.Fatal(err)
+		}
+		anim, err := decodeAnimation(context.Background(), buf.Bytes(), 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Through GIF and animated WebP.
+		gifbuf := &bytes.Buffer{}
+		if err := encodeAnimatedGIF(gifbuf, anim); err != nil {
+			t.Fatal(err)
+		}
+		g2, err := gif.DecodeAll(gifbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g2.LoopCount != loopCount {
+			t.Errorf("Expected GIF LoopCount %d, got %d", loopCount, g2.LoopCount)
+		}
+		webpbuf := &bytes.Buffer{}
+		if err := encodeAnimatedWebP(webpbuf, anim, 50); err != nil {
+			t.Fatal(err)
+		}
+		anim2, err := decodeAnimation(context.Background(), webpbuf.Bytes(), 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if anim2.loops != anim.loops {
+			t.Errorf("LoopCount %d: expected WebP loops %d, got %d", loopCount, anim.loops, anim2.loops)
+		}
+	}
+}
+
+func TestDecodeAnimatedWebPFrameBounds(t *testing.T) {
+	anim, err := decodeAnimation(context.Background(), testGIF(t, 2, false), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := encodeAnimatedWebP(buf, anim, 50); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	ianmf := bytes.Index(data, []byte("ANMF"))
+	putUint24(data[ianmf+8:], 100) // X offset of 200, past the canvas.
+	if _, err := decodeAnimation(context.Background(), data, 0, 0); err == nil {
+		t.Error("Expected an error for a frame outside the canvas")
+	}
+}
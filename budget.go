@@ -0,0 +1,101 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// DefaultResponderTimeout is the time budget of each responder, see Options.
+const DefaultResponderTimeout = time.Minute
+
+// TimeBudgeter is implemented by responders with their own time budget,
+// instead of Options.ResponderTimeout
+//
+// The budget is the req.Context() deadline given to the responder, which is also
+// canceled if the client goes away. When it expires, the responder should stop
+// and pass the original response through if it still can, otherwise return an error response.
+// The budget covers Response, not reading a streamed body afterwards.
+type TimeBudgeter interface {
+	TimeBudget() time.Duration // 0 for the default, negative for no limit.
+}
+
+// timeBudget can be embedded to implement TimeBudgeter.
+type timeBudget struct {
+	budget int64 // atomic
+}
+
+func (b *timeBudget) TimeBudget() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.budget))
+}
+
+func (b *timeBudget) SetTimeBudget(budget time.Duration) {
+	atomic.StoreInt64(&b.budget, int64(budget))
+}
+
+func (proxy *Proxy) getResponderTimeout() time.Duration {
+	proxy.mx.RLock()
+	x := proxy.opts.ResponderTimeout
+	proxy.mx.RUnlock()
+	if x == 0 {
+		x = DefaultResponderTimeout
+	}
+	return x
+}
+
+// clientContext returns a context which is canceled if the client goes away or the proxy stops.
+// Call stop when done with it, before the client connection is used again.
+func (proxy *Proxy) clientContext(ctx *goproxy.ProxyCtx, rd *reqData) (cctx context.Context, stop func()) {
+	parent := proxy.ctx
+	if parent == nil {
+		parent = context.Background() // Not serving.
+	}
+	cctx, cancel := context.WithCancel(parent)
+	var gone <-chan struct{}
+	stopWatch := func() {}
+	if rd.info.MITM {
+		// The requests within are read from the hijacked connection.
+		if rd.conn != nil {
+			gone, stopWatch = rd.conn.watch()
+		}
+	} else {
+		gone = ctx.Req.Context().Done()
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-gone:
+			cancel()
+		case <-finished:
+		}
+	}()
+	return cctx, func() {
+		close(finished)
+		stopWatch()
+		cancel()
+	}
+}
+
+// respond calls the responder within its time budget.
+func (proxy *Proxy) respond(cctx context.Context, er Responder, req *http.Request, resp *http.Response, rd *reqData) *http.Response {
+	budget := proxy.getResponderTimeout()
+	if tb, ok := er.(TimeBudgeter); ok && tb.TimeBudget() != 0 {
+		budget = tb.TimeBudget()
+	}
+	rctx := cctx
+	if budget > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(cctx, budget)
+		defer cancel()
+	}
+	return er.Response(req.WithContext(rd.requestContext(rctx)), resp)
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+// CAOptions are the options for GenerateCA.
+type CAOptions struct {
+	KeyType      string        // "rsa" (default), "ecdsa" or "ed25519"
+	Bits         int           // RSA key size (default 3072), or ECDSA curve size 256 (default) or 384
+	CommonName   string        // Default is "smallprox CA"
+	Organization string        // Optional
+	ValidFor     time.Duration // Default is 10 years
+}
+
+// GenerateCA generates a new self-signed CA suitable for HTTPS MITM.
+// The CA is constrained so it can only sign end-entity certificates.
+func GenerateCA(opts CAOptions) (tls.Certificate, error) {
+	keyType := strings.ToLower(opts.KeyType)
+	if keyType == "" {
+		keyType = KeyTypeRSA
+	}
+	bits := opts.Bits
+	if bits == 0 && keyType == KeyTypeRSA {
+		bits = 3072
+	}
+	priv, err := newKey(keyType, bits, rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ski := sha1.Sum(pubDER)
+	commonName := opts.CommonName
+	if commonName == "" {
+		commonName = "smallprox CA"
+	}
+	validFor := opts.ValidFor
+	if validFor <= 0 {
+		validFor = 10 * 365 * 24 * time.Hour
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             now.Add(-time.Hour), // Allow for some clock skew.
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true, // Only sign leaf certificates.
+		SubjectKeyId:          ski[:],
+	}
+	if opts.Organization != "" {
+		template.Subject.Organization = []string{opts.Organization}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
+
+func randSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// EncodeCertificatePEM encodes the DER certificates as PEM.
+func EncodeCertificatePEM(certs ...[]byte) []byte {
+	var out []byte
+	for _, der := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return out
+}
+
+// EncodePrivateKeyPEM encodes the private key as PKCS#8 PEM,
+// encrypted if password is not empty.
+func EncodePrivateKeyPEM(key crypto.PrivateKey, password []byte) ([]byte, error) {
+	if len(password) != 0 {
+		der, err := pkcs8.ConvertPrivateKeyToPKCS8(key, password)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// FingerprintSHA256 returns the SHA-256 fingerprint of the DER certificate,
+// as colon separated hex.
+func FingerprintSHA256(der []byte) string {
+	sum := sha256.Sum256(der)
+	return fingerprintString(sum[:])
+}
+
+// FingerprintSHA1 returns the SHA-1 fingerprint of the DER certificate,
+// as colon separated hex.
+func FingerprintSHA1(der []byte) string {
+	sum := sha1.Sum(der)
+	return fingerprintString(sum[:])
+}
+
+func fingerprintString(sum []byte) string {
+	x := strings.ToUpper(hex.EncodeToString(sum))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(x); i += 2 {
+		parts = append(parts, x[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,45 @@
+package smallprox
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestGenerateCA(t *testing.T) {
+	for _, opts := range []CAOptions{
+		CAOptions{KeyType: "rsa", Bits: 2048},
+		CAOptions{KeyType: "ecdsa"},
+		CAOptions{KeyType: "ecdsa", Bits: 384, CommonName: "test"},
+	} {
+		ca, err := GenerateCA(opts)
+		if err != nil {
+			t.Errorf("GenerateCA(%+v): %v", opts, err)
+			continue
+		}
+		cert, err := x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !cert.IsCA || !cert.MaxPathLenZero || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+			t.Errorf("Expected CA constraints for %+v", opts)
+		}
+		if err := cert.CheckSignatureFrom(cert); err != nil {
+			t.Errorf("Expected self-signed CA for %+v: %v", opts, err)
+		}
+	}
+	if _, err := GenerateCA(CAOptions{KeyType: "rsa", Bits: 1024}); err == nil {
+		t.Error("Expected error for small RSA key")
+	}
+	if _, err := GenerateCA(CAOptions{KeyType: "dsa"}); err == nil {
+		t.Error("Expected error for unknown key type")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// SHA-1 of the empty string.
+	const expect = "DA:39:A3:EE:5E:6B:4B:0D:32:55:BF:EF:95:60:18:90:AF:D8:07:09"
+	if fp := FingerprintSHA1(nil); fp != expect {
+		t.Errorf("Got %s, expected %s", fp, expect)
+	}
+}
@@ -0,0 +1,579 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/errors/fmt"
+)
+
+// DefaultCacheStaleIfError is how long past freshness a cached response is served if upstream fails, see Options.
+const DefaultCacheStaleIfError = 24 * time.Hour
+
+// Warnings added to stale responses, RFC 7234 section 5.5
+const (
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+	warningDisconnected       = `112 - "Disconnected Operation"`
+)
+
+// cacheControl is the parsed Cache-Control directives, lowercase names to values.
+type cacheControl map[string]string
+
+func parseCacheControl(headers []string) cacheControl {
+	cc := cacheControl{}
+	for _, header := range headers {
+		for _, part := range strings.Split(header, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if ieq := strings.IndexByte(part, '='); ieq != -1 {
+				name = strings.TrimSpace(part[:ieq])
+				value = strings.Trim(strings.TrimSpace(part[ieq+1:]), `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds value of the directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	x, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || x < 0 {
+		return 0, false
+	}
+	if x > 1<<31 {
+		x = 1 << 31
+	}
+	return time.Duration(x) * time.Second, true
+}
+
+// cacheState is the cache state for the current request, see reqData.
+type cacheState struct {
+	url         string
+	requestTime time.Time
+	fromCache   bool       // The response is from the cache, it's already been through the responders.
+	stale       *cacheMeta // Cached but not fresh, kept to revalidate or in case upstream fails.
+	staleBody   []byte
+	validating  bool        // The request has the stale response's validators.
+	conditional http.Header // The client's conditional headers, replaced to revalidate.
+}
+
+// restoreConditional puts back the client's conditional headers, replaced to revalidate.
+func (state *cacheState) restoreConditional(req *http.Request) {
+	if !state.validating {
+		return
+	}
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range state.conditional {
+		req.Header[name] = values
+	}
+	state.validating = false
+}
+
+// conditionalHeaders are the request headers for conditional requests.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// Statuses which may be cached without explicit freshness, RFC 9110 section 15.1
+var heuristicStatuses = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true}
+
+// Hop-by-hop headers aren't cached.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// cacheURL is the cache key for the request.
+func cacheURL(req *http.Request) string {
+	u := *req.URL
+	u.Fragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Host == "" {
+		u.Host = strings.ToLower(req.Host)
+	}
+	if u.Scheme == "http" {
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	} else if u.Scheme == "https" {
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	}
+	return u.String()
+}
+
+// varyValue is the canonical value of the request header for Vary matching.
+// Accept-Encoding is reduced to the acceptable codings in preference order,
+// so clients which negotiate the same get the same response.
+func varyValue(req *http.Request, name string) string {
+	values := req.Header[name]
+	if name == "Accept-Encoding" {
+		if values == nil {
+			return ""
+		}
+		elems := parseAccept(values)
+		var codings []string
+		for _, coding := range []string{"zstd", "br", "gzip", "deflate"} {
+			if q, _ := encodingQuality(elems, coding); q > 0 {
+				codings = append(codings, coding+";q="+strconv.FormatFloat(q, 'g', 3, 64))
+			}
+		}
+		return strings.Join(codings, ",")
+	}
+	return strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+}
+
+// varyNames returns the request headers the response varies on.
+// The proxy's own negotiation is included: the encoding, and the format for images.
+// Returns false if the response can't be matched (Vary: *).
+func varyNames(resp *http.Response) ([]string, bool) {
+	names := []string{"Accept-Encoding"}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		names = append(names, "Accept")
+	}
+	for _, x := range resp.Header["Vary"] {
+		for _, name := range strings.Split(x, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !HasAnyFold(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, true
+}
+
+// freshnessLifetime per RFC 9111 section 4.2.1, for a shared cache.
+func (meta *cacheMeta) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(meta.Header["Cache-Control"])
+	if x, ok := cc.seconds("s-maxage"); ok {
+		return x
+	}
+	if x, ok := cc.seconds("max-age"); ok {
+		return x
+	}
+	date := meta.date()
+	if expiresStr := meta.Header.Get("Expires"); expiresStr != "" {
+		expires, err := http.ParseTime(expiresStr)
+		if err != nil || expires.Before(date) {
+			return 0 // Invalid is already expired.
+		}
+		return expires.Sub(date)
+	}
+	if heuristicStatuses[meta.StatusCode] || cc.has("public") {
+		// Heuristic, 10% of the time since last modified, up to a day.
+		if lm, err := http.ParseTime(meta.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+			x := date.Sub(lm) / 10
+			if x > 24*time.Hour {
+				x = 24 * time.Hour
+			}
+			return x
+		}
+	}
+	return 0
+}
+
+// date is the Date of the response, or the response time.
+func (meta *cacheMeta) date() time.Time {
+	if date, err := http.ParseTime(meta.Header.Get("Date")); err == nil {
+		return date
+	}
+	return meta.ResponseTime
+}
+
+// age is the current age per RFC 9111 section 4.2.3
+func (meta *cacheMeta) age(now time.Time) time.Duration {
+	apparentAge := meta.ResponseTime.Sub(meta.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	responseDelay := meta.ResponseTime.Sub(meta.RequestTime)
+	correctedAgeValue := time.Duration(meta.AgeValue)*time.Second + responseDelay
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(meta.ResponseTime)
+}
+
+// matchesVary returns true if the request has the same Vary values as the cached response.
+func (meta *cacheMeta) matchesVary(req *http.Request) bool {
+	for name, value := range meta.Vary {
+		if varyValue(req, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// PurgeCache removes the cached responses for URLs starting with urlPrefix,
+// or all if empty. Returns the number removed.
+func (proxy *Proxy) PurgeCache(urlPrefix string) int {
+	return proxy.cache.purge(func(url string) bool {
+		return strings.HasPrefix(url, urlPrefix)
+	})
+}
+
+// cacheRequest looks up the request in the cache, it returns the response if cached and fresh.
+// Otherwise rd.cache is set so the response can be cached by cacheResponse.
+func (proxy *Proxy) cacheRequest(req *http.Request, rd *reqData) *http.Response {
+	if !proxy.cache.enabled() {
+		return nil
+	}
+	if req.Method == "PURGE" {
+		if !rd.admin {
+			return newResponse(req, http.StatusMethodNotAllowed, "text/plain", []byte("PURGE requires the admin secret\n"))
+		}
+		return proxy.purgeRequest(req)
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil
+	}
+	reqCC := parseCacheControl(req.Header["Cache-Control"])
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		return nil
+	}
+	state := &cacheState{url: cacheURL(req), requestTime: time.Now()}
+	rd.cache = state
+	meta, body := proxy.cache.lookup(state.url, func(meta *cacheMeta) bool {
+		return meta.matchesVary(req)
+	})
+	if meta == nil {
+		if proxy.isOffline() {
+			return offlineResponse(req)
+		}
+		if reqCC.has("only-if-cached") {
+			return newResponse(req, http.StatusGatewayTimeout, "text/plain", []byte("Not cached"))
+		}
+		return nil
+	}
+	now := time.Now()
+	age := meta.age(now)
+	lifetime := meta.freshnessLifetime()
+	respCC := parseCacheControl(meta.Header["Cache-Control"])
+	fresh := age < lifetime
+	if x, ok := reqCC.seconds("max-age"); ok && age > x {
+		fresh = false
+	}
+	if x, ok := reqCC.seconds("min-fresh"); ok && age+x >= lifetime {
+		fresh = false
+	}
+	if !fresh && reqCC.has("max-stale") && !respCC.has("must-revalidate") && !respCC.has("proxy-revalidate") &&
+		!respCC.has("s-maxage") && !respCC.has("no-cache") {
+		maxStale, ok := reqCC.seconds("max-stale")
+		if !ok || age < lifetime+maxStale {
+			fresh = true
+		}
+	}
+	noCache := reqCC.has("no-cache") || respCC.has("no-cache") ||
+		(!reqCC.has("max-age") && len(req.Header["Cache-Control"]) == 0 && req.Header.Get("Pragma") == "no-cache")
+	if fresh && !noCache {
+		state.fromCache = true
+		return cachedResponse(req, meta, body, age)
+	}
+	if proxy.isOffline() {
+		state.fromCache = true
+		resp := cachedResponse(req, meta, body, age)
+		resp.Header.Set("X-Cache", "STALE")
+		resp.Header.Add("Warning", warningDisconnected)
+		return resp
+	}
+	if reqCC.has("only-if-cached") {
+		return newResponse(req, http.StatusGatewayTimeout, "text/plain", []byte("Not cached"))
+	}
+	state.stale = meta
+	state.staleBody = body
+	if meta.ETag != "" || meta.LastModified != "" {
+		// Revalidate with the upstream validators, not the client's, which are for the cached response.
+		state.validating = true
+		state.conditional = http.Header{}
+		for _, name := range conditionalHeaders {
+			if values, ok := req.Header[name]; ok {
+				state.conditional[name] = values
+				req.Header.Del(name)
+			}
+		}
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	return nil
+}
+
+// cacheRevalidated handles the upstream response to revalidation,
+// it returns the cached response if still valid, otherwise nil.
+func (proxy *Proxy) cacheRevalidated(req *http.Request, resp *http.Response, rd *reqData) *http.Response {
+	state := rd.cache
+	if state == nil || !state.validating || resp.StatusCode != http.StatusNotModified {
+		return nil
+	}
+	resp.Body.Close()
+	state.restoreConditional(req)
+	meta := state.stale
+	oldResponseTime := meta.ResponseTime
+	for _, name := range []string{"Cache-Control", "Expires", "Date"} {
+		if values, ok := resp.Header[name]; ok {
+			meta.Header[name] = values
+		}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		meta.ETag = etag
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		meta.LastModified = lm
+	}
+	meta.RequestTime = state.requestTime
+	meta.ResponseTime = time.Now()
+	meta.AgeValue = 0
+	if age, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		meta.AgeValue = age
+	}
+	proxy.cache.update(meta, oldResponseTime)
+	state.fromCache = true
+	return cachedResponse(req, meta, state.staleBody, meta.age(time.Now()))
+}
+
+// cacheStaleIfError returns the stale cached response to serve because upstream failed, or nil.
+// See RFC 5861 and RFC 9111 section 4.2.4
+func (proxy *Proxy) cacheStaleIfError(req *http.Request, rd *reqData) *http.Response {
+	state := rd.cache
+	if state == nil || state.stale == nil || state.fromCache {
+		return nil
+	}
+	meta := state.stale
+	respCC := parseCacheControl(meta.Header["Cache-Control"])
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") ||
+		respCC.has("no-cache") {
+		return nil
+	}
+	limit := proxy.getCacheStaleIfError()
+	if x, ok := respCC.seconds("stale-if-error"); ok {
+		limit = x
+	}
+	if x, ok := parseCacheControl(req.Header["Cache-Control"]).seconds("stale-if-error"); ok {
+		limit = x
+	}
+	age := meta.age(time.Now())
+	if limit < 0 || age-meta.freshnessLifetime() > limit {
+		return nil
+	}
+	state.restoreConditional(req)
+	state.fromCache = true
+	resp := cachedResponse(req, meta, state.staleBody, age)
+	resp.Header.Set("X-Cache", "STALE")
+	resp.Header.Add("Warning", warningRevalidationFailed)
+	return resp
+}
+
+// cacheResponse arranges for the response to be cached once its body is fully read.
+// upstreamHeader is the response header before the responders, for its validators.
+func (proxy *Proxy) cacheResponse(req *http.Request, resp *http.Response, upstreamHeader http.Header, rd *reqData) {
+	state := rd.cache
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "OPTIONS" && req.Method != "TRACE" {
+		if resp.StatusCode < 400 && proxy.cache.enabled() {
+			// Unsafe methods invalidate, RFC 9111 section 4.4
+			proxy.invalidate(req, resp)
+		}
+		return
+	}
+	if state == nil || req.Method != "GET" {
+		return
+	}
+	if !heuristicStatuses[resp.StatusCode] && resp.StatusCode != http.StatusPermanentRedirect {
+		return
+	}
+	respCC := parseCacheControl(resp.Header["Cache-Control"])
+	if respCC.has("no-store") || respCC.has("private") || len(resp.Header["Set-Cookie"]) != 0 ||
+		isTruncated(resp.Header) {
+		return
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return
+	}
+	names, ok := varyNames(resp)
+	if !ok {
+		return
+	}
+	meta := &cacheMeta{
+		URL:          state.url,
+		Vary:         make(map[string]string, len(names)),
+		StatusCode:   resp.StatusCode,
+		Header:       cloneHeader(resp.Header),
+		RequestTime:  state.requestTime,
+		ResponseTime: time.Now(),
+		ETag:         upstreamHeader.Get("ETag"),
+		LastModified: upstreamHeader.Get("Last-Modified"),
+	}
+	for _, name := range names {
+		meta.Vary[name] = varyValue(req, name)
+	}
+	for _, name := range hopHeaders {
+		meta.Header.Del(name)
+	}
+	if age, err := strconv.ParseInt(meta.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		meta.AgeValue = age
+	}
+	meta.Header.Del("Age")
+	if meta.Header.Get("Date") == "" {
+		meta.Header.Set("Date", meta.ResponseTime.UTC().Format(http.TimeFormat))
+	}
+	if meta.freshnessLifetime() <= 0 && meta.ETag == "" && meta.LastModified == "" {
+		return // Can't be reused.
+	}
+	maxObject := proxy.cache.getMaxObject()
+	if resp.ContentLength > maxObject {
+		return
+	}
+	resp.Body = &cacheTee{r: resp.Body, max: maxObject, done: func(body []byte) {
+		proxy.cache.store(meta, body)
+	}}
+}
+
+// invalidate removes the cached responses for the request URL, and its Location and Content-Location.
+func (proxy *Proxy) invalidate(req *http.Request, resp *http.Response) {
+	urls := []string{cacheURL(req)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if loc := resp.Header.Get(name); loc != "" {
+			if u, err := req.URL.Parse(loc); err == nil && strings.EqualFold(u.Host, req.URL.Host) {
+				urls = append(urls, cacheURL(&http.Request{URL: u, Host: u.Host}))
+			}
+		}
+	}
+	proxy.cache.purge(func(url string) bool {
+		return HasAnyFold(urls, url)
+	})
+}
+
+// purgeRequest handles a PURGE request for a URL, or URLs starting with it if it ends with *
+func (proxy *Proxy) purgeRequest(req *http.Request) *http.Response {
+	var n int
+	u := cacheURL(req)
+	if strings.HasSuffix(u, "*") {
+		n = proxy.PurgeCache(strings.TrimSuffix(u, "*"))
+	} else {
+		n = proxy.cache.purge(func(url string) bool {
+			return url == u
+		})
+	}
+	if n == 0 {
+		return newResponse(req, http.StatusNotFound, "text/plain", []byte("Not cached\n"))
+	}
+	return newResponse(req, http.StatusOK, "text/plain", []byte(fmt.Sprintf("Purged %d\n", n)))
+}
+
+// cachedResponse returns the response from the cache,
+// or 304 Not Modified if the client's conditional request matches.
+func cachedResponse(req *http.Request, meta *cacheMeta, body []byte, age time.Duration) *http.Response {
+	resp := &http.Response{
+		Request:       req,
+		StatusCode:    meta.StatusCode,
+		Status:        fmt.Sprintf("%v %v", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(meta.Header),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	resp.Header.Set("X-Cache", "HIT")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	if meta.StatusCode == http.StatusOK && notModified(req, resp.Header) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = fmt.Sprintf("%v %v", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Type")
+		resp.ContentLength = 0
+		body = nil
+	}
+	if req.Method == "HEAD" {
+		body = nil
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// notModified evaluates the client's If-None-Match or If-Modified-Since against the cached response.
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, x := range strings.Split(inm, ",") {
+			x = strings.TrimSpace(x)
+			if x == "*" || strings.TrimPrefix(x, "W/") == etag {
+				return true // Weak comparison.
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+// cacheTee captures the body as it's read, done is called with the body after EOF.
+// Nothing is captured if the body is larger than max, or not fully read.
+type cacheTee struct {
+	r    io.ReadCloser
+	buf  bytes.Buffer
+	max  int64
+	done func(body []byte)
+	over bool
+}
+
+func (tee *cacheTee) Read(p []byte) (int, error) {
+	n, err := tee.r.Read(p)
+	if n > 0 && !tee.over {
+		if int64(tee.buf.Len()+n) > tee.max {
+			tee.over = true
+			tee.buf = bytes.Buffer{}
+		} else {
+			tee.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !tee.over && tee.done != nil {
+		done := tee.done
+		tee.done = nil
+		done(tee.buf.Bytes())
+	}
+	return n, err
+}
+
+func (tee *cacheTee) Close() error {
+	tee.done = nil
+	return tee.r.Close()
+}
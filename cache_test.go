@@ -0,0 +1,258 @@
+package smallprox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now()
+	date := now.Add(-10 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=5"}}, 5 * time.Second},
+		{http.Header{"Date": {date}, "Expires": {now.Add(50 * time.Second).UTC().Format(http.TimeFormat)}}, time.Minute},
+		{http.Header{"Date": {date}, "Expires": {"0"}}, 0},
+		{http.Header{"Date": {date}, "Last-Modified": {now.Add(-1000*time.Second - 10*time.Second).UTC().Format(http.TimeFormat)}}, 100 * time.Second},
+		{http.Header{}, 0},
+	}
+	for _, tt := range tests {
+		meta := &cacheMeta{StatusCode: 200, Header: tt.header, RequestTime: now, ResponseTime: now}
+		if got := meta.freshnessLifetime(); got != tt.lifetime {
+			t.Errorf("%v: lifetime %v, expected %v", tt.header, got, tt.lifetime)
+		}
+	}
+	meta := &cacheMeta{Header: http.Header{"Date": {date}}, AgeValue: 5, RequestTime: now, ResponseTime: now}
+	if age := meta.age(now.Add(time.Second)); age < 11*time.Second || age > 12*time.Second {
+		t.Errorf("Unexpected age %v", age)
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallprox-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newCacheStore()
+	if err := store.configure(40*1024, dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	any := func(*cacheMeta) bool { return true }
+	body := []byte(strings.Repeat("x", 5000))
+	for _, u := range []string{"http://a/", "http://b/", "http://c/", "http://d/"} {
+		store.store(&cacheMeta{URL: u, StatusCode: 200, Header: http.Header{}, ResponseTime: time.Now()}, body)
+	}
+	// Memory fits only some, the rest are on disk.
+	if store.memSize > store.maxMem {
+		t.Errorf("Memory over limit: %d", store.memSize)
+	}
+	for _, u := range []string{"http://a/", "http://d/"} {
+		meta, got := store.lookup(u, any)
+		if meta == nil || string(got) != string(body) {
+			t.Errorf("Expected %s cached", u)
+		}
+	}
+	// Variants.
+	store.store(&cacheMeta{URL: "http://a/", Vary: map[string]string{"Accept-Encoding": "gzip"},
+		StatusCode: 200, Header: http.Header{}, ResponseTime: time.Now()}, []byte("gz"))
+	meta, got := store.lookup("http://a/", func(meta *cacheMeta) bool { return meta.Vary["Accept-Encoding"] == "gzip" })
+	if meta == nil || string(got) != "gz" {
+		t.Error("Expected the gzip variant")
+	}
+
+	// Reload from disk.
+	store2 := newCacheStore()
+	if err := store2.configure(40*1024, dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if meta, got := store2.lookup("http://b/", any); meta == nil || string(got) != string(body) {
+		t.Error("Expected http://b/ from disk")
+	}
+	if n := store2.purge(func(url string) bool { return url == "http://a/" }); n != 2 {
+		t.Errorf("Expected 2 purged, got %d", n)
+	}
+	if meta, _ := store2.lookup("http://a/", any); meta != nil {
+		t.Error("Expected http://a/ purged")
+	}
+}
+
+func TestCacheProxy(t *testing.T) {
+	proxy := NewProxy(Options{CacheSize: 1 << 20})
+	newReq := func(ae string) (*http.Request, *reqData) {
+		req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+		req.Header.Set("Accept-Encoding", ae)
+		return req, &reqData{}
+	}
+	respond := func(req *http.Request, rd *reqData, header http.Header, body string) {
+		resp := &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+		proxy.cacheResponse(req, resp, header, rd)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	req, rd := newReq("gzip, br")
+	if resp := proxy.cacheRequest(req, rd); resp != nil {
+		t.Fatal("Unexpected cache hit")
+	}
+	respond(req, rd, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"1"`}}, "hello")
+
+	req, rd = newReq("br,gzip")
+	resp := proxy.cacheRequest(req, rd)
+	if resp == nil {
+		t.Fatal("Expected a cache hit")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello" || resp.Header.Get("X-Cache") != "HIT" || !rd.cache.fromCache {
+		t.Errorf("Unexpected cached response %q %v", body, resp.Header)
+	}
+
+	req, rd = newReq("br,gzip")
+	req.Header.Set("If-None-Match", `"1"`)
+	if resp := proxy.cacheRequest(req, rd); resp == nil || resp.StatusCode != http.StatusNotModified {
+		t.Error("Expected 304 from the cache")
+	}
+
+	req, rd = newReq("gzip")
+	if resp := proxy.cacheRequest(req, rd); resp != nil {
+		t.Error("Expected a miss for a different encoding")
+	}
+
+	// Revalidation.
+	req, rd = newReq("identity")
+	proxy.cacheRequest(req, rd)
+	respond(req, rd, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"2"`}}, "revalidate me")
+	req, rd = newReq("identity")
+	if resp := proxy.cacheRequest(req, rd); resp != nil {
+		t.Fatal("Expected revalidation")
+	}
+	if req.Header.Get("If-None-Match") != `"2"` {
+		t.Errorf("Expected the upstream validator, got %q", req.Header.Get("If-None-Match"))
+	}
+	notModified := &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	resp = proxy.cacheRevalidated(req, notModified, rd)
+	if resp == nil {
+		t.Fatal("Expected the cached response")
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != "revalidate me" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	// Purge.
+	req, _ = http.NewRequest("PURGE", "http://example.com/*", nil)
+	if resp := proxy.cacheRequest(req, &reqData{}); resp == nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Expected PURGE refused without the admin secret")
+	}
+	if resp := proxy.cacheRequest(req, &reqData{admin: true}); resp == nil || resp.StatusCode != 200 {
+		t.Error("Expected purged")
+	}
+	req, rd = newReq("gzip, br")
+	if resp := proxy.cacheRequest(req, rd); resp != nil {
+		t.Error("Expected a miss after purge")
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	proxy := NewProxy(Options{CacheSize: 1 << 20})
+	store := func(url, cc string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		rd := &reqData{}
+		proxy.cacheRequest(req, rd)
+		date := time.Now().Add(-2 * time.Minute).UTC().Format(http.TimeFormat)
+		header := http.Header{"Cache-Control": {cc}, "Date": {date}}
+		resp := &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(strings.NewReader("stale"))}
+		proxy.cacheResponse(req, resp, header, rd)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	store("http://example.com/a", "max-age=60")
+	store("http://example.com/b", "max-age=60, must-revalidate")
+	store("http://example.com/c", "max-age=60, stale-if-error=0")
+
+	for _, x := range []struct {
+		url   string
+		stale bool
+	}{
+		{"http://example.com/a", true},
+		{"http://example.com/b", false},
+		{"http://example.com/c", false},
+		{"http://example.com/missing", false},
+	} {
+		req, _ := http.NewRequest("GET", x.url, nil)
+		rd := &reqData{}
+		if resp := proxy.cacheRequest(req, rd); resp != nil {
+			t.Fatalf("%s: expected a stale entry", x.url)
+		}
+		resp := proxy.cacheStaleIfError(req, rd)
+		if (resp != nil) != x.stale {
+			t.Errorf("%s: expected stale=%v", x.url, x.stale)
+			continue
+		}
+		if resp != nil && (resp.Header.Get("Warning") == "" || resp.Header.Get("X-Cache") != "STALE") {
+			t.Errorf("%s: unexpected header %v", x.url, resp.Header)
+		}
+	}
+
+	opts := proxy.GetOptions()
+	opts.Offline = true
+	proxy.SetOptions(opts)
+	req, _ := http.NewRequest("GET", "http://example.com/b", nil)
+	resp := proxy.cacheRequest(req, &reqData{})
+	if resp == nil || resp.StatusCode != 200 || resp.Header.Get("Warning") == "" {
+		t.Error("Expected the stale response when offline")
+	}
+	req, _ = http.NewRequest("GET", "http://example.com/missing", nil)
+	resp = proxy.cacheRequest(req, &reqData{})
+	if resp == nil || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Expected the offline page")
+	}
+}
+
+func TestCacheStaleIfErrorMITM(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", time.Now().Add(-2*time.Minute).UTC().Format(http.TimeFormat))
+		w.Write([]byte("stale"))
+	}))
+	defer upstream.Close()
+	proxy, addr := startTestProxy(t, Options{ConnectMITM: true, CacheSize: 1 << 20})
+	defer proxy.Close()
+	proxy.server.Tr.Dial = func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	}
+
+	for i, want := range []string{"", "STALE"} {
+		conn, r, status := connectProxy(t, addr, "upstream.test:80", "")
+		if status != 200 {
+			t.Fatalf("Expected CONNECT 200, got %d", status)
+		}
+		fmt.Fprintf(conn, "GET /page HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode != 200 || string(body) != "stale" || resp.Header.Get("X-Cache") != want {
+			t.Errorf("Request %d: unexpected %d %q %v", i, resp.StatusCode, body, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// Cache defaults, see Options.
+const (
+	DefaultCacheDirSize   = 1 << 30
+	DefaultCacheMaxObject = 10 << 20
+)
+
+// cacheOverhead is roughly the memory used by a cached response other than its body.
+const cacheOverhead = 1024
+
+// cacheMeta is everything about a cached response other than its body.
+type cacheMeta struct {
+	URL          string
+	Vary         map[string]string // Canonical request header values the response varies on.
+	StatusCode   int
+	Header       http.Header // Response header, after the responders.
+	RequestTime  time.Time
+	ResponseTime time.Time
+	AgeValue     int64  // Age header from upstream, in seconds.
+	ETag         string // Upstream validator, for revalidation.
+	LastModified string // Upstream validator, for revalidation.
+}
+
+// cacheVariant is a cached response.
+type cacheVariant struct {
+	meta     cacheMeta
+	size     int64  // Body size.
+	body     []byte // nil if only on disk.
+	file     string // Empty if not on disk.
+	offset   int64  // Offset of the body in file.
+	memElem  *list.Element
+	diskElem *list.Element
+}
+
+// cacheStore holds the cached responses in memory and optionally on disk, by URL.
+// The least recently used are removed to fit the size limits.
+type cacheStore struct {
+	mx        sync.Mutex
+	maxMem    int64
+	maxDisk   int64
+	maxObject int64
+	dir       string
+	entries   map[string][]*cacheVariant
+	mem       *list.List // of *cacheVariant, front is most recent.
+	disk      *list.List // of *cacheVariant, front is most recent.
+	memSize   int64
+	diskSize  int64
+}
+
+func newCacheStore() *cacheStore {
+	return &cacheStore{
+		entries: make(map[string][]*cacheVariant),
+		mem:     list.New(),
+		disk:    list.New(),
+	}
+}
+
+// configure sets the limits; if dir changes, the disk tier is loaded from dir.
+// maxMem of 0 disables the cache.
+func (store *cacheStore) configure(maxMem int64, dir string, maxDisk, maxObject int64) error {
+	if maxDisk <= 0 {
+		maxDisk = DefaultCacheDirSize
+	}
+	if maxObject <= 0 {
+		maxObject = DefaultCacheMaxObject
+	}
+	if maxMem <= 0 {
+		dir = ""
+	}
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	store.maxMem = maxMem
+	store.maxDisk = maxDisk
+	store.maxObject = maxObject
+	var err error
+	if dir != store.dir {
+		store.purgeLocked(func(*cacheVariant) bool { return true }, false)
+		store.dir = dir
+		if dir != "" {
+			err = store.loadDirLocked()
+			if err != nil {
+				store.dir = ""
+				err = fmt.Errorf("unable to use cache dir, using memory only: %w", err)
+			}
+		}
+	}
+	store.evictLocked()
+	return err
+}
+
+func (store *cacheStore) enabled() bool {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	return store.maxMem > 0
+}
+
+func (store *cacheStore) getMaxObject() int64 {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	return store.maxObject
+}
+
+// lookup returns the meta and body of the most recent response for url accepted by match.
+// The returned meta is a copy.
+func (store *cacheStore) lookup(url string, match func(meta *cacheMeta) bool) (*cacheMeta, []byte) {
+	store.mx.Lock()
+	var found *cacheVariant
+	for _, v := range store.entries[url] {
+		if match(&v.meta) && (found == nil || v.meta.ResponseTime.After(found.meta.ResponseTime)) {
+			found = v
+		}
+	}
+	if found == nil {
+		store.mx.Unlock()
+		return nil, nil
+	}
+	meta := found.meta
+	meta.Header = cloneHeader(found.meta.Header)
+	body := found.body
+	file, offset, size := found.file, found.offset, found.size
+	if found.memElem != nil {
+		store.mem.MoveToFront(found.memElem)
+	}
+	if found.diskElem != nil {
+		store.disk.MoveToFront(found.diskElem)
+	}
+	store.mx.Unlock()
+	if body != nil {
+		return &meta, body
+	}
+	body, err := readCacheBody(file, offset, size)
+	if err != nil {
+		log.Printf("Cache error: %s", err)
+		store.remove(found)
+		return nil, nil
+	}
+	// Promote to memory.
+	store.mx.Lock()
+	if found.diskElem != nil && found.body == nil && store.fitsMemLocked(size) {
+		found.body = body
+		found.memElem = store.mem.PushFront(found)
+		store.memSize += size + cacheOverhead
+		store.evictLocked()
+	}
+	store.mx.Unlock()
+	return &meta, body
+}
+
+// store adds a response, replacing any with the same URL and Vary values.
+func (store *cacheStore) store(meta *cacheMeta, body []byte) {
+	size := int64(len(body))
+	store.mx.Lock()
+	if size > store.maxObject || (!store.fitsMemLocked(size) && store.dir == "") {
+		store.mx.Unlock()
+		return
+	}
+	dir := store.dir
+	store.mx.Unlock()
+
+	v := &cacheVariant{meta: *meta, size: size}
+	if dir != "" {
+		file, offset, err := writeCacheFile(dir, meta, body)
+		if err != nil {
+			log.Printf("Cache error: %s", err)
+		} else {
+			v.file = file
+			v.offset = offset
+		}
+	}
+
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	if store.dir != dir {
+		// Reconfigured meanwhile.
+		if v.file != "" {
+			os.Remove(v.file)
+		}
+		return
+	}
+	for _, old := range store.entries[meta.URL] {
+		if sameVary(old.meta.Vary, meta.Vary) {
+			store.removeLocked(old, true)
+		}
+	}
+	if store.fitsMemLocked(size) {
+		v.body = body
+		v.memElem = store.mem.PushFront(v)
+		store.memSize += size + cacheOverhead
+	}
+	if v.file != "" {
+		v.diskElem = store.disk.PushFront(v)
+		store.diskSize += size + cacheOverhead
+	}
+	if v.memElem == nil && v.diskElem == nil {
+		return
+	}
+	store.entries[meta.URL] = append(store.entries[meta.URL], v)
+	store.evictLocked()
+}
+
+// update replaces the meta of the response for url with the same Vary values and response time.
+// The meta on disk is not updated, after a restart the response is just revalidated again.
+func (store *cacheStore) update(meta *cacheMeta, oldResponseTime time.Time) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	for _, v := range store.entries[meta.URL] {
+		if sameVary(v.meta.Vary, meta.Vary) && v.meta.ResponseTime.Equal(oldResponseTime) {
+			v.meta = *meta
+			return
+		}
+	}
+}
+
+// purge removes the responses for which fn returns true, returns the number removed.
+func (store *cacheStore) purge(fn func(url string) bool) int {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	return store.purgeLocked(func(v *cacheVariant) bool { return fn(v.meta.URL) }, true)
+}
+
+func (store *cacheStore) purgeLocked(fn func(v *cacheVariant) bool, removeFiles bool) int {
+	n := 0
+	for _, vs := range store.entries {
+		for _, v := range vs {
+			if fn(v) {
+				store.removeLocked(v, removeFiles)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (store *cacheStore) remove(v *cacheVariant) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	store.removeLocked(v, true)
+}
+
+func (store *cacheStore) removeLocked(v *cacheVariant, removeFile bool) {
+	vs := store.entries[v.meta.URL]
+	for i, x := range vs {
+		if x == v {
+			vs = append(vs[:i:i], vs[i+1:]...)
+			break
+		}
+	}
+	if len(vs) == 0 {
+		delete(store.entries, v.meta.URL)
+	} else {
+		store.entries[v.meta.URL] = vs
+	}
+	store.removeMemLocked(v)
+	if v.diskElem != nil {
+		store.disk.Remove(v.diskElem)
+		v.diskElem = nil
+		store.diskSize -= v.size + cacheOverhead
+		if removeFile {
+			os.Remove(v.file)
+		}
+	}
+}
+
+func (store *cacheStore) removeMemLocked(v *cacheVariant) {
+	if v.memElem != nil {
+		store.mem.Remove(v.memElem)
+		v.memElem = nil
+		v.body = nil
+		store.memSize -= v.size + cacheOverhead
+	}
+}
+
+// fitsMemLocked returns true if a body of size is small enough for the memory tier.
+func (store *cacheStore) fitsMemLocked(size int64) bool {
+	return size+cacheOverhead <= store.maxMem/4
+}
+
+func (store *cacheStore) evictLocked() {
+	for store.memSize > store.maxMem && store.mem.Len() > 0 {
+		v := store.mem.Back().Value.(*cacheVariant)
+		if v.diskElem != nil {
+			store.removeMemLocked(v) // Still on disk.
+		} else {
+			store.removeLocked(v, true)
+		}
+	}
+	for store.diskSize > store.maxDisk && store.disk.Len() > 0 {
+		v := store.disk.Back().Value.(*cacheVariant)
+		store.removeLocked(v, true)
+	}
+}
+
+// loadDirLocked loads the index of the disk tier.
+func (store *cacheStore) loadDirLocked() error {
+	err := os.MkdirAll(store.dir, 0700)
+	if err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(store.dir, "*.cache"))
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		v       *cacheVariant
+		modTime time.Time
+	}
+	var all []loaded
+	for _, fp := range paths {
+		meta, offset, size, modTime, err := readCacheMeta(fp)
+		if err != nil {
+			log.Printf("Removing bad cache file %s: %s", fp, err)
+			os.Remove(fp)
+			continue
+		}
+		all = append(all, loaded{&cacheVariant{meta: *meta, size: size, file: fp, offset: offset}, modTime})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.After(all[j].modTime) })
+	for _, x := range all {
+		v := x.v
+		v.diskElem = store.disk.PushBack(v)
+		store.diskSize += v.size + cacheOverhead
+		store.entries[v.meta.URL] = append(store.entries[v.meta.URL], v)
+	}
+	return nil
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+// Cache file format: cacheFileMagic, uint32 meta length, JSON meta, body.
+const cacheFileMagic = "smallprox cache 1\n"
+
+func writeCacheFile(dir string, meta *cacheMeta, body []byte) (string, int64, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", 0, err
+	}
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return "", 0, err
+	}
+	sum := sha256.Sum256([]byte(meta.URL))
+	name := hex.EncodeToString(sum[:12]) + "-" + hex.EncodeToString(rnd[:8]) + ".cache"
+	fp := filepath.Join(dir, name)
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(cacheFileMagic)
+	var lenbuf [4]byte
+	binary.BigEndian.PutUint32(lenbuf[:], uint32(len(metaJSON)))
+	w.Write(lenbuf[:])
+	w.Write(metaJSON)
+	w.Write(body)
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return fp, int64(len(cacheFileMagic) + 4 + len(metaJSON)), nil
+}
+
+const maxCacheMeta = 1 << 20
+
+func readCacheMeta(fp string) (*cacheMeta, int64, int64, time.Time, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, 0, 0, time.Time{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, time.Time{}, err
+	}
+	r := bufio.NewReader(f)
+	hdr := make([]byte, len(cacheFileMagic)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, 0, 0, time.Time{}, err
+	}
+	if string(hdr[:len(cacheFileMagic)]) != cacheFileMagic {
+		return nil, 0, 0, time.Time{}, errors.New("not a cache file")
+	}
+	metaLen := int64(binary.BigEndian.Uint32(hdr[len(cacheFileMagic):]))
+	offset := int64(len(hdr)) + metaLen
+	if metaLen > maxCacheMeta || offset > st.Size() {
+		return nil, 0, 0, time.Time{}, errors.New("bad cache file")
+	}
+	meta := &cacheMeta{}
+	err = json.NewDecoder(io.LimitReader(r, metaLen)).Decode(meta)
+	if err != nil {
+		return nil, 0, 0, time.Time{}, err
+	}
+	if meta.URL == "" || strings.ContainsAny(meta.URL, "\r\n") {
+		return nil, 0, 0, time.Time{}, errors.New("bad cache file URL")
+	}
+	return meta, offset, st.Size() - offset, st.ModTime(), nil
+}
+
+func readCacheBody(fp string, offset, size int64) ([]byte, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	body := make([]byte, size)
+	_, err = f.ReadAt(body, offset)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
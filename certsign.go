@@ -8,78 +8,54 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"io"
 	"math/big"
 	"net"
-	"strings"
-	"sync"
 	"time"
 
 	"golang.org/x/exp/errors"
 	"golang.org/x/exp/errors/fmt"
 )
 
-type myCertEnt struct {
-	cert *tls.Certificate
-	t    time.Time
-}
+// DefaultLeafValidity is how long MITM certificates are valid by default.
+const DefaultLeafValidity = 30 * 24 * time.Hour
 
-type myCertStore struct {
-	m  map[string]myCertEnt
-	mx sync.Mutex
-}
+// Browsers reject certificates valid for more than 398 days.
+const maxLeafValidity = 397 * 24 * time.Hour
 
-func (store *myCertStore) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
-	store.mx.Lock()
-	defer store.mx.Unlock()
-	lhostname := strings.ToLower(hostname)
-	if e, ok := store.m[lhostname]; ok {
-		return e.cert, nil
-	}
-	now := time.Now()
-	const maxEnts = 50
-	if len(store.m) >= maxEnts {
-		old := now.Add(-time.Hour)
-		for k, v := range store.m {
-			if v.t.Before(old) {
-				delete(store.m, k)
-			}
-		}
-		for len(store.m) >= maxEnts {
-			for k := range store.m {
-				delete(store.m, k)
-				break
-			}
-		}
-	}
-	cert, err := gen()
-	if err != nil {
-		return nil, err
-	}
-	store.m[lhostname] = myCertEnt{cert: cert, t: now}
-	return cert, nil
+// leafSpec is what to put in a MITM certificate.
+type leafSpec struct {
+	Hosts    []string  // DNS names (wildcards allowed) and IP addresses
+	Subject  pkix.Name // If no CommonName, the first DNS name is used.
+	ValidFor time.Duration
 }
 
-func newCertStore() *myCertStore {
-	return &myCertStore{m: make(map[string]myCertEnt)}
-}
-
-func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+// signHost signs a certificate for spec with certpriv, or a new key if nil.
+func signHost(ca tls.Certificate, spec leafSpec, certpriv crypto.Signer) (cert *tls.Certificate, err error) {
 	var x509ca *x509.Certificate
 
 	if x509ca, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
 		return
 	}
-	start := time.Unix(0, 0)
-	end, err := time.Parse("2006-01-02", "2049-12-31")
-	if err != nil {
-		panic(err)
+	validFor := spec.ValidFor
+	if validFor <= 0 {
+		validFor = DefaultLeafValidity
+	}
+	if validFor > maxLeafValidity {
+		validFor = maxLeafValidity
+	}
+	now := time.Now()
+	start := now.Add(-time.Hour) // Allow for some clock skew.
+	end := now.Add(validFor)
+	if end.After(x509ca.NotAfter) {
+		end = x509ca.NotAfter
 	}
 	hash := make([]byte, 20)
 	_, err = rand.Read(hash)
@@ -91,22 +67,22 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	template := x509.Certificate{
 		SerialNumber: serial,
 		Issuer:       x509ca.Subject,
-		Subject: pkix.Name{
-			Organization: []string{"Internet Widgits Pty Ltd"},
-		},
-		NotBefore: start,
-		NotAfter:  end,
+		Subject:      spec.Subject,
+		NotBefore:    start,
+		NotAfter:     end,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
-	for _, h := range hosts {
+	for _, h := range spec.Hosts {
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
 		} else {
 			template.DNSNames = append(template.DNSNames, h)
-			template.Subject.CommonName = h
+			if template.Subject.CommonName == "" {
+				template.Subject.CommonName = h
+			}
 		}
 	}
 
@@ -115,30 +91,38 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		return
 	}
 
-	var certpriv crypto.Signer
-	switch ca.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		if certpriv, err = rsa.GenerateKey(&csprng, 2048); err != nil {
-			return
-		}
-	case *ecdsa.PrivateKey:
-		if certpriv, err = ecdsa.GenerateKey(elliptic.P256(), &csprng); err != nil {
+	if certpriv == nil {
+		if certpriv, err = newLeafKey("", ca.PrivateKey, &csprng); err != nil {
 			return
 		}
-	default:
-		err = fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+	}
+
+	if _, ok := certpriv.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
 
 	var derBytes []byte
 	if derBytes, err = x509.CreateCertificate(&csprng, &template, x509ca, certpriv.Public(), ca.PrivateKey); err != nil {
 		return
 	}
+	// Serve the CA chain along with the certificate.
 	return &tls.Certificate{
-		Certificate: [][]byte{derBytes, ca.Certificate[0]},
+		Certificate: append([][]byte{derBytes}, ca.Certificate...),
 		PrivateKey:  certpriv,
 	}, nil
 }
 
+// newLeafKey generates a leaf key of keyType, or of the same type as the CA key if empty.
+func newLeafKey(keyType string, caKey crypto.PrivateKey, rand io.Reader) (crypto.Signer, error) {
+	if keyType == "" {
+		keyType = keyTypeOf(caKey)
+		if keyType == "" {
+			return nil, fmt.Errorf("unsupported key type %T", caKey)
+		}
+	}
+	return newKey(keyType, 0, rand)
+}
+
 type CounterEncryptorRand struct {
 	cipher  cipher.Block
 	counter []byte
@@ -155,8 +139,10 @@ func NewCounterEncryptorRandFromKey(key interface{}, seed []byte) (r CounterEncr
 		if keyBytes, err = x509.MarshalECPrivateKey(key); err != nil {
 			return
 		}
+	case ed25519.PrivateKey:
+		keyBytes = key.Seed()
 	default:
-		err = errors.New("only RSA and ECDSA keys supported")
+		err = errors.New("only RSA, ECDSA and Ed25519 keys supported")
 		return
 	}
 	h := sha256.New()
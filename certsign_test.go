@@ -0,0 +1,48 @@
+package smallprox
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestSignHost(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := signHost(ca, leafSpec{
+		Hosts:    []string{"www.example.com", "*.example.com", "10.1.2.3"},
+		Subject:  pkix.Name{Organization: []string{"Example"}},
+		ValidFor: 1000 * 24 * time.Hour,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > 398*24*time.Hour {
+		t.Errorf("Certificate lifetime too long: %v", lifetime)
+	}
+	if leaf.Subject.CommonName != "www.example.com" || len(leaf.Subject.Organization) != 1 {
+		t.Errorf("Unexpected subject: %v", leaf.Subject)
+	}
+	for _, name := range []string{"www.example.com", "foo.example.com"} {
+		if err := leaf.VerifyHostname(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(leaf.IPAddresses) != 1 {
+		t.Errorf("Expected an IP address SAN")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(caCert); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultCertCacheSize is the default number of leaf certificates kept in memory.
+const DefaultCertCacheSize = 1000
+
+// Reissue a cached certificate this close to expiring,
+// or a quarter of its lifetime if less.
+const certExpiryMargin = 24 * time.Hour
+
+type myCertEnt struct {
+	hostname string // lowercase
+	cert     *tls.Certificate
+}
+
+// myCertStore is an LRU cache of leaf certificates,
+// optionally persisted to disk encrypted with a key derived from the CA.
+// Certificates are generated without holding the lock, once per hostname at a time.
+type myCertStore struct {
+	mx    sync.Mutex
+	max   int
+	lru   *list.List // of *myCertEnt, most recently used at the front
+	m     map[string]*list.Element
+	caFP  string         // CA fingerprint
+	disk  *certDiskCache // nil if no disk cache
+	group singleflight.Group
+}
+
+func newCertStore() *myCertStore {
+	return &myCertStore{
+		max: DefaultCertCacheSize,
+		lru: list.New(),
+		m:   make(map[string]*list.Element),
+	}
+}
+
+// configure sets up the store for the CA; if the CA changed, the memory cache is cleared.
+// dir is the disk cache directory, or empty for memory only.
+func (store *myCertStore) configure(ca tls.Certificate, maxEnts int, dir string) error {
+	if maxEnts <= 0 {
+		maxEnts = DefaultCertCacheSize
+	}
+	var caFP string
+	if len(ca.Certificate) != 0 {
+		caFP = FingerprintSHA256(ca.Certificate[0])
+	}
+	var disk *certDiskCache
+	var err error
+	if dir != "" {
+		disk, err = newCertDiskCache(ca, caFP, dir)
+		// Memory only on error.
+	}
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	if caFP != store.caFP {
+		store.lru.Init()
+		store.m = make(map[string]*list.Element)
+	}
+	store.caFP = caFP
+	store.max = maxEnts
+	store.disk = disk
+	store.trimLocked()
+	return err
+}
+
+func (store *myCertStore) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	lhostname := strings.ToLower(hostname)
+	if cert := store.get(lhostname); cert != nil {
+		return cert, nil
+	}
+	x, err, _ := store.group.Do(lhostname, func() (interface{}, error) {
+		// Check again, it might have been added while waiting.
+		if cert := store.get(lhostname); cert != nil {
+			return cert, nil
+		}
+		store.mx.Lock()
+		caFP := store.caFP
+		disk := store.disk
+		store.mx.Unlock()
+		if disk != nil {
+			cert, err := disk.load(lhostname)
+			if err == nil && certUsable(cert, time.Now()) {
+				store.add(lhostname, cert, caFP)
+				return cert, nil
+			}
+		}
+		cert, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+		store.add(lhostname, cert, caFP)
+		if disk != nil {
+			err = disk.save(lhostname, cert)
+			if err != nil {
+				log.Printf("Unable to save certificate for %s: %s", hostname, err)
+			}
+		}
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x.(*tls.Certificate), nil
+}
+
+// get returns the usable cached certificate, or nil.
+func (store *myCertStore) get(lhostname string) *tls.Certificate {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	if el, ok := store.m[lhostname]; ok {
+		e := el.Value.(*myCertEnt)
+		if certUsable(e.cert, time.Now()) {
+			store.lru.MoveToFront(el)
+			return e.cert
+		}
+		store.lru.Remove(el)
+		delete(store.m, lhostname)
+	}
+	return nil
+}
+
+// add the certificate, unless the CA changed from caFP.
+func (store *myCertStore) add(lhostname string, cert *tls.Certificate, caFP string) {
+	store.mx.Lock()
+	defer store.mx.Unlock()
+	if caFP != store.caFP {
+		return
+	}
+	if el, ok := store.m[lhostname]; ok {
+		store.lru.Remove(el)
+	}
+	store.m[lhostname] = store.lru.PushFront(&myCertEnt{hostname: lhostname, cert: cert})
+	store.trimLocked()
+}
+
+func certUsable(cert *tls.Certificate, now time.Time) bool {
+	if cert.Leaf == nil {
+		return false
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	if lifetime > maxLeafValidity+24*time.Hour {
+		return false // From before validity was limited.
+	}
+	margin := lifetime / 4
+	if margin > certExpiryMargin {
+		margin = certExpiryMargin
+	}
+	return now.Add(margin).Before(cert.Leaf.NotAfter)
+}
+
+func (store *myCertStore) trimLocked() {
+	for store.lru.Len() > store.max {
+		el := store.lru.Back()
+		store.lru.Remove(el)
+		delete(store.m, el.Value.(*myCertEnt).hostname)
+	}
+}
+
+// certDiskCache stores certificates in files keyed by hostname and CA fingerprint.
+type certDiskCache struct {
+	dir  string
+	caFP string
+	aead cipher.AEAD
+}
+
+func newCertDiskCache(ca tls.Certificate, caFP string, dir string) (*certDiskCache, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, "smallprox cert cache\x00")
+	h.Write(keyDER)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &certDiskCache{dir: dir, caFP: caFP, aead: aead}, nil
+}
+
+func (disk *certDiskCache) path(lhostname string) string {
+	sum := sha256.Sum256([]byte(disk.caFP + "\x00" + lhostname))
+	return filepath.Join(disk.dir, hex.EncodeToString(sum[:20])+".cert")
+}
+
+func (disk *certDiskCache) load(lhostname string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(disk.path(lhostname))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := disk.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("invalid certificate cache file")
+	}
+	plain, err := disk.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(lhostname))
+	if err != nil {
+		return nil, err
+	}
+	// The PEM has both the certificates and the key.
+	cert, err := tls.X509KeyPair(plain, plain)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (disk *certDiskCache) save(lhostname string, cert *tls.Certificate) error {
+	plain := &bytes.Buffer{}
+	plain.Write(EncodeCertificatePEM(cert.Certificate...))
+	keyPEM, err := EncodePrivateKeyPEM(cert.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	plain.Write(keyPEM)
+	nonce := make([]byte, disk.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	data := disk.aead.Seal(nonce, nonce, plain.Bytes(), []byte(lhostname))
+	fp := disk.path(lhostname)
+	tmp := fp + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
@@ -0,0 +1,119 @@
+package smallprox
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCertStore(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "smallprox-certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gens := 0
+	fetch := func(store *myCertStore, host string) *tls.Certificate {
+		cert, err := store.Fetch(host, func() (*tls.Certificate, error) {
+			gens++
+			return signHost(ca, leafSpec{Hosts: []string{host}}, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	store := newCertStore()
+	if err := store.configure(ca, 2, dir); err != nil {
+		t.Fatal(err)
+	}
+	a := fetch(store, "a.example")
+	fetch(store, "b.example")
+	if fetch(store, "A.example") != a || gens != 2 {
+		t.Errorf("Expected cached certificate, gens=%d", gens)
+	}
+	fetch(store, "c.example") // Evicts b.
+	if store.lru.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", store.lru.Len())
+	}
+	if _, ok := store.m["b.example"]; ok {
+		t.Error("Expected b.example to be evicted")
+	}
+
+	// A new store loads from disk.
+	store2 := newCertStore()
+	if err := store2.configure(ca, 2, dir); err != nil {
+		t.Fatal(err)
+	}
+	gens = 0
+	b := fetch(store2, "b.example")
+	if gens != 0 {
+		t.Error("Expected certificate from disk cache")
+	}
+	if b.Leaf == nil || b.Leaf.Subject.CommonName != "b.example" {
+		t.Error("Unexpected certificate from disk cache")
+	}
+
+	// A different CA does not use the old certificates.
+	ca2, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store2.configure(ca2, 2, dir); err != nil {
+		t.Fatal(err)
+	}
+	ca = ca2
+	fetch(store2, "b.example")
+	if gens != 1 {
+		t.Error("Expected a new certificate for a new CA")
+	}
+}
+
+func TestCertStoreConcurrent(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newCertStore()
+	store.configure(ca, 0, "")
+	pool := newKeyPool(2, func() (crypto.Signer, error) {
+		return newLeafKey("", ca.PrivateKey, rand.Reader)
+	})
+	defer pool.Stop()
+	var gens int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Fetch("a.example", func() (*tls.Certificate, error) {
+				atomic.AddInt32(&gens, 1)
+				time.Sleep(10 * time.Millisecond)
+				key, err := pool.Get()
+				if err != nil {
+					return nil, err
+				}
+				return signHost(ca, leafSpec{Hosts: []string{"a.example"}}, key)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if gens != 1 {
+		t.Errorf("Expected 1 certificate generated, got %d", gens)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientListener wraps the accepted connections in clientConn, done with ctx.
+type clientListener struct {
+	net.Listener
+	ctx context.Context
+}
+
+func (ln clientListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newClientConn(ln.ctx, conn), nil
+}
+
+// maxWatchBuffer is the most read from the client while watching for it to go away.
+const maxWatchBuffer = 64 << 10
+
+// clientConn is a client connection which can be watched for the client going away
+// while a hijacked connection isn't otherwise being read, such as within a MITM CONNECT.
+// Anything read while watching is returned by Read afterwards.
+// Writes are rate limited by the current shape, see RateLimits,
+// and counted by the current quota account, see Quotas.
+type clientConn struct {
+	net.Conn
+	ctx     context.Context // Done when closed, for shaped writes to stop waiting.
+	cancel  func()
+	mx      sync.Mutex
+	buf     []byte
+	err     error        // Read error while watching.
+	shape   atomic.Value // []*tokenBucket
+	account atomic.Value // *quotaAccount
+}
+
+func newClientConn(ctx context.Context, conn net.Conn) *clientConn {
+	ctx, cancel := context.WithCancel(ctx)
+	return &clientConn{Conn: conn, ctx: ctx, cancel: cancel}
+}
+
+func (c *clientConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *clientConn) setShape(buckets []*tokenBucket) {
+	c.shape.Store(buckets)
+}
+
+func (c *clientConn) setAccount(acct *quotaAccount) {
+	c.account.Store(acct)
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if acct, _ := c.account.Load().(*quotaAccount); acct != nil {
+		n, err := c.shapedWrite(b)
+		if n > 0 {
+			acct.add(n)
+		}
+		return n, err
+	}
+	return c.shapedWrite(b)
+}
+
+func (c *clientConn) shapedWrite(b []byte) (int, error) {
+	buckets, _ := c.shape.Load().([]*tokenBucket)
+	if len(buckets) == 0 {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for len(b) != 0 {
+		chunk := b
+		if len(chunk) > shapeChunk {
+			chunk = chunk[:shapeChunk]
+		}
+		if err := waitBuckets(c.ctx, buckets, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	if len(c.buf) != 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		c.mx.Unlock()
+		return n, nil
+	}
+	err := c.err
+	c.mx.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// watch reads from the connection in the background until stop is called,
+// gone is closed if the client closes the connection in the mean time.
+// Only call when nothing else is reading the connection, and call stop before reading.
+func (c *clientConn) watch() (gone <-chan struct{}, stop func()) {
+	goneCh := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var b [4096]byte
+		for {
+			c.mx.Lock()
+			full := len(c.buf) >= maxWatchBuffer || c.err != nil
+			c.mx.Unlock()
+			if full {
+				return
+			}
+			n, err := c.Conn.Read(b[:])
+			c.mx.Lock()
+			c.buf = append(c.buf, b[:n]...)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.mx.Unlock()
+					return // Stopped.
+				}
+				c.err = err
+				c.mx.Unlock()
+				close(goneCh)
+				return
+			}
+			c.mx.Unlock()
+		}
+	}()
+	return goneCh, func() {
+		c.Conn.SetReadDeadline(time.Unix(1, 0)) // Interrupt the read.
+		<-finished
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+type clientConnKey struct{}
+
+func clientConnFromContext(ctx context.Context) *clientConn {
+	c, _ := ctx.Value(clientConnKey{}).(*clientConn)
+	return c
+}
@@ -0,0 +1,74 @@
+package smallprox
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientConnWatch(t *testing.T) {
+	server, client := net.Pipe()
+	c := newClientConn(context.Background(), server)
+
+	gone, stop := c.watch()
+	client.Write([]byte("pipelined"))
+	stop()
+	select {
+	case <-gone:
+		t.Fatal("The client did not go away")
+	default:
+	}
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "pipelined" {
+		t.Fatalf("Expected the data read while watching, got %q %v", buf[:n], err)
+	}
+
+	go client.Write([]byte("more"))
+	n, err = c.Read(buf)
+	if err != nil || string(buf[:n]) != "more" {
+		t.Fatalf("Expected to read after watching, got %q %v", buf[:n], err)
+	}
+
+	gone, stop = c.watch()
+	client.Close()
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to be gone")
+	}
+	stop()
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+type budgetResponder struct {
+	timeBudget
+	deadline time.Duration
+}
+
+func (er *budgetResponder) Response(req *http.Request, resp *http.Response) *http.Response {
+	if deadline, ok := req.Context().Deadline(); ok {
+		er.deadline = time.Until(deadline)
+	}
+	return resp
+}
+
+func TestResponderBudget(t *testing.T) {
+	proxy := NewProxy(Options{ResponderTimeout: time.Hour})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	er := &budgetResponder{}
+	proxy.respond(context.Background(), er, req, &http.Response{}, &reqData{})
+	if er.deadline <= time.Minute || er.deadline > time.Hour {
+		t.Errorf("Expected the default budget, got %v", er.deadline)
+	}
+	er.SetTimeBudget(time.Second)
+	proxy.respond(context.Background(), er, req, &http.Response{}, &reqData{})
+	if er.deadline <= 0 || er.deadline > time.Second {
+		t.Errorf("Expected the responder's budget, got %v", er.deadline)
+	}
+}
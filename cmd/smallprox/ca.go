@@ -0,0 +1,210 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/millerlogic/smallprox"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// runCA runs the ca subcommand: smallprox ca <init|show|export> [flags]
+func runCA(args []string) error {
+	if len(args) == 0 {
+		caUsage()
+		return errors.New("ca subcommand expected")
+	}
+	switch args[0] {
+	case "init":
+		return runCAInit(args[1:])
+	case "show":
+		return runCAShow(args[1:])
+	case "export":
+		return runCAExport(args[1:])
+	case "help", "-h", "-help", "--help":
+		caUsage()
+		return nil
+	default:
+		caUsage()
+		return fmt.Errorf("unknown ca subcommand: %s", args[0])
+	}
+}
+
+func caUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s ca:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  init    Generate a new CA certificate and private key\n")
+	fmt.Fprintf(os.Stderr, "  show    Show a CA certificate and its fingerprints\n")
+	fmt.Fprintf(os.Stderr, "  export  Export a CA certificate as PEM, DER or PKCS#12\n")
+	fmt.Fprintf(os.Stderr, "Use %s ca <subcommand> -h for subcommand flags\n", os.Args[0])
+}
+
+func runCAInit(args []string) error {
+	fs := flag.NewFlagSet("ca init", flag.ExitOnError)
+	cacert := fs.String("cacert", "ca.pem", "Output CA certificate file")
+	cakey := fs.String("cakey", "ca.key", "Output CA private key file")
+	var opts smallprox.CAOptions
+	fs.StringVar(&opts.KeyType, "keyType", "rsa", "Key type: rsa, ecdsa or ed25519")
+	fs.IntVar(&opts.Bits, "bits", 0, "RSA key size (default 3072) or ECDSA curve size (default 256)")
+	fs.StringVar(&opts.CommonName, "cn", "smallprox CA", "CA common name")
+	fs.StringVar(&opts.Organization, "org", "", "CA organization")
+	days := fs.Int("days", 3650, "Number of days the CA is valid")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s ca init:\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "The key is encrypted if SMALLPROX_CAKEY_PW is set\n")
+	}
+	fs.Parse(args)
+	opts.ValidFor = time.Duration(*days) * 24 * time.Hour
+
+	if !*force {
+		for _, fp := range []string{*cacert, *cakey} {
+			if _, err := os.Stat(fp); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite", fp)
+			}
+		}
+	}
+
+	ca, err := smallprox.GenerateCA(opts)
+	if err != nil {
+		return err
+	}
+	var caKeyPw []byte
+	if pw, hasPw := os.LookupEnv("SMALLPROX_CAKEY_PW"); hasPw {
+		caKeyPw = []byte(pw)
+	}
+	keyPEM, err := smallprox.EncodePrivateKeyPEM(ca.PrivateKey, caKeyPw)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*cakey, keyPEM, 0600)
+	if err != nil {
+		return fmt.Errorf("-cakey error: %w", err)
+	}
+	err = ioutil.WriteFile(*cacert, smallprox.EncodeCertificatePEM(ca.Certificate...), 0644)
+	if err != nil {
+		return fmt.Errorf("-cacert error: %w", err)
+	}
+	fmt.Printf("Wrote %s and %s\n", *cacert, *cakey)
+	fmt.Printf("SHA-256 Fingerprint: %s\n", smallprox.FingerprintSHA256(ca.Certificate[0]))
+	return nil
+}
+
+func runCAShow(args []string) error {
+	fs := flag.NewFlagSet("ca show", flag.ExitOnError)
+	cacert := fs.String("cacert", "ca.pem", "CA certificate file")
+	fs.Parse(args)
+
+	certs, err := loadCertsFile(*cacert)
+	if err != nil {
+		return fmt.Errorf("-cacert error: %w", err)
+	}
+	for i, cert := range certs {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Subject: %s\n", cert.Subject)
+		fmt.Printf("Issuer: %s\n", cert.Issuer)
+		fmt.Printf("Serial: %X\n", cert.SerialNumber)
+		fmt.Printf("Not Before: %s\n", cert.NotBefore.UTC())
+		fmt.Printf("Not After: %s\n", cert.NotAfter.UTC())
+		fmt.Printf("Public Key: %s\n", cert.PublicKeyAlgorithm)
+		fmt.Printf("CA: %v\n", cert.IsCA)
+		fmt.Printf("SHA-256 Fingerprint: %s\n", smallprox.FingerprintSHA256(cert.Raw))
+		fmt.Printf("SHA-1 Fingerprint: %s\n", smallprox.FingerprintSHA1(cert.Raw))
+	}
+	return nil
+}
+
+func runCAExport(args []string) error {
+	fs := flag.NewFlagSet("ca export", flag.ExitOnError)
+	cacert := fs.String("cacert", "ca.pem", "CA certificate file")
+	format := fs.String("format", "der", "Output format: pem, der or p12")
+	out := fs.String("out", "", "Output file (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s ca export:\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "The p12 format only contains the certificate, protected by SMALLPROX_P12_PW if set\n")
+	}
+	fs.Parse(args)
+	if *out == "" {
+		fs.Usage()
+		return errors.New("-out is required")
+	}
+
+	certPEM, err := ioutil.ReadFile(*cacert)
+	if err != nil {
+		return fmt.Errorf("-cacert error: %w", err)
+	}
+	// Clients trust the root, the same as offered by the onboarding page.
+	cert, err := smallprox.LoadCARoot(certPEM)
+	if err != nil {
+		return fmt.Errorf("-cacert error: %w", err)
+	}
+	if cert == nil {
+		certs, err := loadCertsFile(*cacert)
+		if err != nil {
+			return fmt.Errorf("-cacert error: %w", err)
+		}
+		cert = certs[len(certs)-1]
+	}
+	var data []byte
+	switch *format {
+	case "pem":
+		data = smallprox.EncodeCertificatePEM(cert.Raw)
+	case "der":
+		data = cert.Raw
+	case "p12", "pfx", "pkcs12":
+		data, err = pkcs12.EncodeTrustStore(rand.Reader, []*x509.Certificate{cert}, os.Getenv("SMALLPROX_P12_PW"))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown -format: %s", *format)
+	}
+	err = ioutil.WriteFile(*out, data, 0644)
+	if err != nil {
+		return fmt.Errorf("-out error: %w", err)
+	}
+	return nil
+}
+
+func loadCertsFile(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/millerlogic/smallprox"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// imageHostOptions returns the -shrinkImagesHost values, based on opts:
+// host[,host...]=off or host[,host...]=setting:value[,setting:value...]
+func imageHostOptions(opts smallprox.ImageShrinkOptions, values []string) ([]smallprox.ImageShrinkHostOptions, error) {
+	var hostOptions []smallprox.ImageShrinkHostOptions
+	for _, x := range values {
+		hosts, settings, err := splitHostsValue(x)
+		if err != nil {
+			return nil, fmt.Errorf("-shrinkImagesHost: %w", err)
+		}
+		hostOpts := opts
+		for _, setting := range strings.Split(settings, ",") {
+			if err := setImageOption(&hostOpts, setting); err != nil {
+				return nil, fmt.Errorf("-shrinkImagesHost %s: %w", x, err)
+			}
+		}
+		hostOptions = append(hostOptions, smallprox.ImageShrinkHostOptions{
+			Hosts:   strings.Split(hosts, ","),
+			Options: hostOpts,
+		})
+	}
+	return hostOptions, nil
+}
+
+// setImageOption sets an option from setting:value, the value is optional for on/off settings.
+func setImageOption(opts *smallprox.ImageShrinkOptions, setting string) error {
+	name, value := setting, ""
+	if icolon := strings.IndexByte(setting, ':'); icolon != -1 {
+		name, value = setting[:icolon], setting[icolon+1:]
+	}
+	parseBool := func() (bool, error) {
+		if value == "" {
+			return true, nil
+		}
+		return strconv.ParseBool(value)
+	}
+	var err error
+	switch strings.ToLower(name) {
+	case "off":
+		opts.Disabled = true
+	case "on":
+		opts.Disabled = false
+	case "maxdim":
+		opts.MaxDimension, err = strconv.Atoi(value)
+	case "webpquality":
+		opts.WebPQuality, err = strconv.Atoi(value)
+	case "jpegquality":
+		opts.JPEGQuality, err = strconv.Atoi(value)
+	case "minsize":
+		var minSize bytesFlag
+		err = minSize.Set(value)
+		opts.MinSize = int64(minSize)
+	case "gray":
+		opts.Grayscale, err = parseBool()
+	case "progressive":
+		opts.ProgressiveJPEG, err = parseBool()
+	case "animated":
+		opts.Animated, err = smallprox.ParseAnimationMode(value)
+	case "animatedmaxframes":
+		opts.AnimatedMaxFrames, err = strconv.Atoi(value)
+	case "animatedmaxdim":
+		opts.AnimatedMaxDimension, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown setting %q, expected off, on, maxDim, webpQuality, jpegQuality, minSize, gray, progressive, animated, animatedMaxFrames or animatedMaxDim", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return checkImageOptions(opts)
+}
+
+func checkImageOptions(opts *smallprox.ImageShrinkOptions) error {
+	if opts.WebPQuality < 1 || opts.WebPQuality > 100 || opts.JPEGQuality < 1 || opts.JPEGQuality > 100 {
+		return fmt.Errorf("image quality must be from 1 to 100")
+	}
+	return nil
+}
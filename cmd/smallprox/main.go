@@ -8,8 +8,6 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/pem"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -17,10 +15,10 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
 	"github.com/millerlogic/smallprox"
-	"github.com/youmark/pkcs8"
 	"golang.org/x/exp/errors"
 	"golang.org/x/exp/errors/fmt"
 )
@@ -32,6 +30,9 @@ func run() error {
 	limiter.SetLimit(1024 * 1024 * 100)
 	flimiter := &limiterFlag{limiter: limiter}
 
+	downloadConfirm := &smallprox.DownloadConfirmResponder{}
+	fdownloadConfirm := &limiterFlag{limiter: downloadConfirm}
+
 	imageShrinker := &smallprox.ImageShrinkResponder{}
 	imageShrinker.SetEnabled(false)
 	fimageShrinker := &toggleFlag{toggle: imageShrinker}
@@ -53,19 +54,76 @@ func run() error {
 	fs := flag.CommandLine
 	fs.BoolVar(&opts.Verbose, "v", opts.Verbose, "Verbose output")
 	fs.Var((*arrayFlags)(&opts.Addresses), "addr", "Proxy listen address(es)")
-	fs.BoolVar(&opts.InsecureSkipVerify, "insecure", opts.InsecureSkipVerify, "TLS config InsecureSkipVerify")
+	fs.BoolVar(&opts.InsecureSkipVerify, "insecure", opts.InsecureSkipVerify, "Don't verify upstream TLS certificates, unless a host rule applies (insecure)")
+	var upstreamCAs, upstreamPins, insecureHosts []string
+	fs.Var((*arrayFlags)(&upstreamCAs), "upstreamCA", "Verify upstream hosts against the CA(s) in a PEM file instead of the system CAs: host[,host...]=file")
+	fs.Var((*arrayFlags)(&upstreamPins), "upstreamPin", "Require an upstream host's chain to contain this public key: host[,host...]=base64sha256")
+	fs.Var((*arrayFlags)(&insecureHosts), "insecureHost", "Don't verify the TLS certificate of this upstream host (insecure)")
 	var blockHostsFiles []string
 	fs.Var((*arrayFlags)(&blockHostsFiles), "blockHostsFile", "Block the hosts found in this file(s), one per line or in /etc/hosts format")
 	fs.BoolVar(&opts.ConnectMITM, "connectMITM", opts.ConnectMITM, "Enable man-in-the-middle for HTTP CONNECT connections")
 	fs.BoolVar(&opts.HTTPSMITM, "httpsMITM", opts.HTTPSMITM, "Enable man-in-the-middle for HTTPS CONNECT connections")
 	var cacert, cakey string
-	fs.StringVar(&cacert, "cacert", cacert, "CA certificate file for HTTPS MITM")
+	fs.StringVar(&cacert, "cacert", cacert, "CA certificate file for HTTPS MITM, followed by any intermediates")
 	fs.StringVar(&cakey, "cakey", cakey, "CA private key file for HTTPS MITM")
+	fs.BoolVar(&opts.AllowDefaultCA, "allowDefaultCA", opts.AllowDefaultCA, "Allow HTTPS MITM with the publicly known built-in CA (insecure)")
+	fs.IntVar(&opts.CertCacheSize, "certCacheSize", smallprox.DefaultCertCacheSize, "Max HTTPS MITM certificates cached in memory")
+	fs.StringVar(&opts.CertCacheDir, "certCacheDir", opts.CertCacheDir, "Directory to cache HTTPS MITM certificates across restarts, encrypted")
+	fs.IntVar(&opts.KeyPoolSize, "keyPoolSize", 4, "Number of HTTPS MITM keys to pregenerate in the background")
+	fs.StringVar(&opts.LeafKeyType, "leafKeyType", opts.LeafKeyType, "HTTPS MITM certificate key type: rsa, ecdsa or ed25519 (default same as CA)")
+	fs.DurationVar(&opts.LeafCertValidity, "certValidity", smallprox.DefaultLeafValidity, "How long HTTPS MITM certificates are valid, at most 397 days")
 	fs.Var(fnoscript, "noscript", "Remove JavaScript from HTML content *")
 	fs.Var(fcompressor, "compress", "Compress highly compressable content *")
+	compressEncodings := strings.Join(smallprox.DefaultCompressEncodings, ",")
+	fs.StringVar(&compressEncodings, "compressEncodings", compressEncodings, "Encodings for -compress in order of preference")
+	zstdLevel := smallprox.DefaultZstdLevel
+	fs.IntVar(&zstdLevel, "zstdLevel", zstdLevel, "zstd level for -compress, 1 (fastest) to 22")
 	fs.Var(flimiter, "limitContent", "Limit content to minimize excessive memory usage *")
+	limitPolicy := smallprox.LimitTruncate.String()
+	fs.StringVar(&limitPolicy, "limitPolicy", limitPolicy, "What to do with content over the limit: truncate, error or passthrough (untransformed)")
+	var limitTypes []string
+	fs.Var((*arrayFlags)(&limitTypes), "limitType", "Limit content of a MIME type, or major type such as image/*, instead of -limitContent: type=size")
+	fs.Var(fdownloadConfirm, "confirmDownloads", "Ask to confirm downloads larger than this, with a one-time link to download anyway *")
 	fs.Var(fimageShrinker, "shrinkImages", "Make images/pictures smaller *")
+	var shrinkImagesTimeout time.Duration
+	imageOpts := smallprox.DefaultImageShrinkOptions
+	fs.IntVar(&imageOpts.MaxDimension, "shrinkImagesMaxDim", imageOpts.MaxDimension, "Max width and height of shrunk images, 0 to keep the size")
+	fs.IntVar(&imageOpts.WebPQuality, "shrinkImagesWebPQuality", imageOpts.WebPQuality, "WebP quality of shrunk images, 1 to 100")
+	fs.IntVar(&imageOpts.JPEGQuality, "shrinkImagesJPEGQuality", imageOpts.JPEGQuality, "JPEG quality of shrunk images, 1 to 100")
+	fs.Var((*bytesFlag)(&imageOpts.MinSize), "shrinkImagesMinSize", "Leave images smaller than this as is")
+	fs.BoolVar(&imageOpts.Grayscale, "shrinkImagesGray", imageOpts.Grayscale, "Make shrunk images grayscale")
+	fs.BoolVar(&imageOpts.ProgressiveJPEG, "shrinkImagesProgressive", imageOpts.ProgressiveJPEG, "Make shrunk JPEG images progressive, requires jpegtran")
+	animated := imageOpts.Animated.String()
+	fs.StringVar(&animated, "shrinkImagesAnimated", animated, "Animated GIF and WebP images: pass (as is), still (first frame) or reencode (fewer frames, smaller)")
+	fs.IntVar(&imageOpts.AnimatedMaxFrames, "shrinkImagesAnimatedMaxFrames", imageOpts.AnimatedMaxFrames, "Max frames of re-encoded animations, 0 for all")
+	fs.IntVar(&imageOpts.AnimatedMaxDimension, "shrinkImagesAnimatedMaxDim", imageOpts.AnimatedMaxDimension, "Max width and height of re-encoded animations, 0 for -shrinkImagesMaxDim")
+	var imageHosts []string
+	fs.Var((*arrayFlags)(&imageHosts), "shrinkImagesHost", "Image shrinking for destination hosts: host[,host...]=off or host[,host...]=maxDim:2048,webpQuality:50,jpegQuality:60,minSize:10KiB,gray,progressive,animated:still")
+	fs.DurationVar(&shrinkImagesTimeout, "shrinkImagesTimeout", shrinkImagesTimeout, "Time budget to shrink an image before passing the original through (default -responderTimeout)")
+	fs.DurationVar(&opts.ResponderTimeout, "responderTimeout", smallprox.DefaultResponderTimeout, "Time budget of each response handler, negative for no limit")
 	fs.StringVar(&opts.Auth, "auth", opts.Auth, "Proxy authentication, username:password")
+	fs.Var((*bytesFlag)(&opts.CacheSize), "cacheSize", "Cache responses in memory up to this size, 0 to disable the cache")
+	fs.StringVar(&opts.CacheDir, "cacheDir", opts.CacheDir, "Directory to also cache responses on disk, requires -cacheSize")
+	opts.CacheDirSize = smallprox.DefaultCacheDirSize
+	fs.Var((*bytesFlag)(&opts.CacheDirSize), "cacheDirSize", "Max size of the -cacheDir cache")
+	opts.CacheMaxObject = smallprox.DefaultCacheMaxObject
+	fs.Var((*bytesFlag)(&opts.CacheMaxObject), "cacheMaxObject", "Max size of a cached response")
+	fs.DurationVar(&opts.CacheStaleIfError, "staleIfError", smallprox.DefaultCacheStaleIfError, "Serve cached responses up to this long past freshness if upstream fails, negative to disable")
+	fs.BoolVar(&opts.Offline, "offline", opts.Offline, "Only serve from the cache, never contact upstream")
+	fs.Var((*bytesFlag)(&opts.RateLimits.Global), "rateLimit", "Limit the bytes per second from upstream and to clients, of all clients together")
+	fs.Var((*bytesFlag)(&opts.RateLimits.PerClient), "clientRateLimit", "Limit the bytes per second from upstream and to each client, by -auth user or IP")
+	var clientRates, hostRates []string
+	fs.Var((*arrayFlags)(&clientRates), "clientRate", "Limit the bytes per second of a client instead of -clientRateLimit: user-or-ip=rate")
+	fs.Var((*arrayFlags)(&hostRates), "hostRateLimit", "Limit the bytes per second of destination hosts together: host[,host...]=rate")
+	fs.Var((*bytesFlag)(&opts.Quotas.PerClient.Daily), "dailyQuota", "Data each client can use per day, by -auth user or IP, counted as sent to the client")
+	fs.Var((*bytesFlag)(&opts.Quotas.PerClient.Monthly), "monthlyQuota", "Data each client can use per month, by -auth user or IP, counted as sent to the client")
+	var clientQuotaValues []string
+	fs.Var((*arrayFlags)(&clientQuotaValues), "clientQuota", "Data quotas of a client instead of -dailyQuota and -monthlyQuota, 0 for unlimited: user-or-ip=daily/monthly")
+	quotaAction := smallprox.QuotaBlock.String()
+	fs.StringVar(&quotaAction, "quotaAction", quotaAction, "What to do when a client's quota is used up: block, save (force -noscript and -shrinkImages) or warn (banner)")
+	fs.StringVar(&opts.Quotas.File, "quotaFile", opts.Quotas.File, "File to keep the quota usage across restarts")
+	fs.StringVar(&opts.OnboardHost, "onboardHost", smallprox.DefaultOnboardHost, "Host name of the CA download and onboarding page served by the proxy, empty to disable")
+	fs.BoolVar(&opts.OnboardNoAuth, "onboardNoAuth", opts.OnboardNoAuth, "Allow the onboarding page without -auth")
 	var blockFonts bool
 	fs.BoolVar(&blockFonts, "blockFonts", blockFonts, "Block font files *")
 	var blockTypes []string
@@ -74,6 +132,8 @@ func run() error {
 		fmt.Fprintf(fs.Output(), "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
 		fmt.Fprintf(fs.Output(), "* only applies to CONNECT if MITM enabled\n")
+		fmt.Fprintf(fs.Output(), "Use %s ca to create and manage a CA for -httpsMITM\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Use %s quota to inspect and reset the quota usage\n", os.Args[0])
 	}
 	fs.Parse(os.Args[1:])
 
@@ -85,6 +145,31 @@ func run() error {
 		opts.BlockHosts = append(opts.BlockHosts, blockHosts...)
 	}
 
+	upstreamTLS, err := upstreamTLSRules(upstreamCAs, upstreamPins, insecureHosts)
+	if err != nil {
+		return err
+	}
+	opts.UpstreamTLS = upstreamTLS
+
+	err = rateLimits(&opts.RateLimits, clientRates, hostRates)
+	if err != nil {
+		return err
+	}
+
+	err = clientQuotas(&opts.Quotas, clientQuotaValues)
+	if err != nil {
+		return err
+	}
+	opts.Quotas.Action, err = smallprox.ParseQuotaAction(quotaAction)
+	if err != nil {
+		return fmt.Errorf("-quotaAction error: %w", err)
+	}
+
+	if secret, hasSecret := os.LookupEnv("SMALLPROX_ADMIN_SECRET"); hasSecret {
+		os.Unsetenv("SMALLPROX_ADMIN_SECRET")
+		opts.AdminSecret = secret
+	}
+
 	if cacert != "" || cakey != "" {
 		if !opts.HTTPSMITM {
 			return errors.New("-cacert and -cakey require -httpsMITM")
@@ -97,25 +182,82 @@ func run() error {
 		if err != nil {
 			return fmt.Errorf("-cakey error: %w", err)
 		}
-		if caKeyPw, hasPw := os.LookupEnv("SMALLPROX_CAKEY_PW"); hasPw {
+		var caKeyPw []byte
+		if pw, hasPw := os.LookupEnv("SMALLPROX_CAKEY_PW"); hasPw {
 			os.Unsetenv("SMALLPROX_CAKEY_PW")
-			block, _ := pem.Decode(caKey)
-			privkey, err := pkcs8.ParsePKCS8PrivateKeyRSA(block.Bytes, []byte(caKeyPw))
-			if err != nil {
-				return fmt.Errorf("Problem decrypting -cakey file: %w", err)
-			}
-			certblock, _ := pem.Decode(caCert)
-			proxyCa := tls.Certificate{
-				Certificate: [][]byte{certblock.Bytes},
-				PrivateKey:  privkey,
-			}
-			opts.CA = proxyCa
-		} else {
-			proxyCa, err := tls.X509KeyPair(caCert, caKey)
-			if err != nil {
-				return fmt.Errorf("CA error: %w", err)
-			}
-			opts.CA = proxyCa
+			caKeyPw = []byte(pw)
+		}
+		proxyCa, err := smallprox.LoadCA(caCert, caKey, caKeyPw)
+		if err != nil {
+			return fmt.Errorf("CA error: %w", err)
+		}
+		opts.CA = proxyCa
+		opts.OnboardCA, err = smallprox.LoadCARoot(caCert)
+		if err != nil {
+			return fmt.Errorf("CA error: %w", err)
+		}
+	}
+
+	if opts.LeafKeyType != "" {
+		opts.LeafKeyType, err = smallprox.ParseKeyType(opts.LeafKeyType)
+		if err != nil {
+			return fmt.Errorf("-leafKeyType error: %w", err)
+		}
+	}
+
+	if opts.HTTPSMITM && opts.CA.PrivateKey == nil {
+		if !opts.AllowDefaultCA {
+			return errors.New("-httpsMITM requires -cacert and -cakey (see: ca init), or -allowDefaultCA")
+		}
+		log.Print("WARNING: using the publicly known built-in CA for HTTPS MITM")
+	}
+
+	err = compressor.SetEncodings(strings.Split(compressEncodings, ","))
+	if err != nil {
+		return fmt.Errorf("-compressEncodings error: %w", err)
+	}
+	if zstdLevel < 1 || zstdLevel > 22 {
+		return errors.New("-zstdLevel must be from 1 to 22")
+	}
+	compressor.SetZstdLevel(zstdLevel)
+
+	policy, err := smallprox.ParseLimitPolicy(limitPolicy)
+	if err != nil {
+		return fmt.Errorf("-limitPolicy error: %w", err)
+	}
+	limiter.SetPolicy(policy)
+	for _, x := range limitTypes {
+		ieq := strings.LastIndexByte(x, '=')
+		if ieq == -1 {
+			return fmt.Errorf("-limitType expected type=size, not %q", x)
+		}
+		var limit bytesFlag
+		if err := limit.Set(x[ieq+1:]); err != nil {
+			return fmt.Errorf("-limitType %s error: %w", x, err)
+		}
+		limiter.SetTypeLimit(x[:ieq], int64(limit))
+	}
+	imageShrinker.SetTimeBudget(shrinkImagesTimeout)
+	imageOpts.Animated, err = smallprox.ParseAnimationMode(animated)
+	if err != nil {
+		return fmt.Errorf("-shrinkImagesAnimated error: %w", err)
+	}
+	if err := checkImageOptions(&imageOpts); err != nil {
+		return fmt.Errorf("-shrinkImages error: %w", err)
+	}
+	imageShrinker.SetOptions(imageOpts)
+	imageHostOpts, err := imageHostOptions(imageOpts, imageHosts)
+	if err != nil {
+		return err
+	}
+	imageShrinker.SetHostOptions(imageHostOpts)
+	progressive := imageOpts.ProgressiveJPEG
+	for _, hostOpts := range imageHostOpts {
+		progressive = progressive || hostOpts.Options.ProgressiveJPEG
+	}
+	if progressive {
+		if err := smallprox.CheckProgressiveJPEG(); err != nil {
+			return err
 		}
 	}
 
@@ -126,7 +268,9 @@ func run() error {
 
 	proxy := smallprox.NewProxy(opts)
 
-	proxy.AddResponder(limiter) // First.
+	proxy.AddRequester(downloadConfirm)
+	proxy.AddResponder(downloadConfirm) // First, before the body is read.
+	proxy.AddResponder(limiter)
 	proxy.AddResponder(tfilter)
 	proxy.AddResponder(imageShrinker)
 	proxy.AddResponder(noscript)
@@ -148,13 +292,20 @@ func run() error {
 		}
 	}()
 
-	err := proxy.ListenAndServeContext(ctx)
+	err = proxy.ListenAndServeContext(ctx)
 	close(finished)
 	return err
 }
 
 func main() {
-	err := run()
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		err = runCA(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "quota" {
+		err = runQuota(os.Args[2:])
+	} else {
+		err = run()
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
 		log.Fatalf("ERROR %v", err)
@@ -252,3 +403,28 @@ func (f *limiterFlag) Set(x string) error {
 func (f *limiterFlag) Get() interface{} {
 	return f.limiter.Limit()
 }
+
+type bytesFlag int64
+
+func (f *bytesFlag) String() string {
+	if f == nil || *f <= 0 {
+		return "0"
+	}
+	return strings.Replace(humanize.IBytes(uint64(*f)), " ", "", -1)
+}
+
+func (f *bytesFlag) Set(x string) error {
+	bytes, err := humanize.ParseBytes(x)
+	if err != nil {
+		return err
+	}
+	if bytes > math.MaxInt64 {
+		return errors.New("Too large")
+	}
+	*f = bytesFlag(bytes)
+	return nil
+}
+
+func (f *bytesFlag) Get() interface{} {
+	return int64(*f)
+}
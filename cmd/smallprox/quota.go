@@ -0,0 +1,168 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/millerlogic/smallprox"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// clientQuotas adds the -clientQuota values to quotas: user-or-ip=daily/monthly
+func clientQuotas(quotas *smallprox.Quotas, values []string) error {
+	for _, x := range values {
+		client, value, err := splitHostsValue(x)
+		if err != nil {
+			return fmt.Errorf("-clientQuota: %w", err)
+		}
+		islash := strings.IndexByte(value, '/')
+		if islash == -1 {
+			return fmt.Errorf("-clientQuota expected user-or-ip=daily/monthly, not %q", x)
+		}
+		var daily, monthly bytesFlag
+		if err := daily.Set(value[:islash]); err != nil {
+			return fmt.Errorf("-clientQuota %s: %w", x, err)
+		}
+		if err := monthly.Set(value[islash+1:]); err != nil {
+			return fmt.Errorf("-clientQuota %s: %w", x, err)
+		}
+		if quotas.Clients == nil {
+			quotas.Clients = make(map[string]smallprox.Quota)
+		}
+		quotas.Clients[client] = smallprox.Quota{Daily: int64(daily), Monthly: int64(monthly)}
+	}
+	return nil
+}
+
+// runQuota runs the quota subcommand: smallprox quota <list|reset> [flags]
+func runQuota(args []string) error {
+	if len(args) == 0 {
+		quotaUsage()
+		return errors.New("quota subcommand expected")
+	}
+	switch args[0] {
+	case "list":
+		return runQuotaList(args[1:])
+	case "reset":
+		return runQuotaReset(args[1:])
+	case "help", "-h", "-help", "--help":
+		quotaUsage()
+		return nil
+	default:
+		quotaUsage()
+		return fmt.Errorf("unknown quota subcommand: %s", args[0])
+	}
+}
+
+func quotaUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s quota:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  list   Show the data used by each client\n")
+	fmt.Fprintf(os.Stderr, "  reset  Reset the data used by a client, or by all clients\n")
+	fmt.Fprintf(os.Stderr, "Use %s quota <subcommand> -h for subcommand flags\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "The proxy only serves the quota API to the local host, set SMALLPROX_ADMIN_SECRET as for the proxy\n")
+}
+
+// quotaAPI returns the URL of the quota API of the proxy at addr.
+func quotaAPI(addr, path string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return (&url.URL{Scheme: "http", Host: addr, Path: path}).String()
+}
+
+// quotaAPIDo sends a request to the quota API of the proxy at addr, with the admin secret from SMALLPROX_ADMIN_SECRET.
+func quotaAPIDo(method, addr, path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(method, quotaAPI(addr, path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set(smallprox.AdminSecretHeader, os.Getenv("SMALLPROX_ADMIN_SECRET"))
+	return http.DefaultClient.Do(req)
+}
+
+// apiError returns an error for an unexpected API response.
+func apiError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("proxy responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func runQuotaList(args []string) error {
+	fs := flag.NewFlagSet("quota list", flag.ExitOnError)
+	addr := fs.String("proxy", ":8080", "Proxy address, as in -addr")
+	asJSON := fs.Bool("json", false, "Output JSON")
+	fs.Parse(args)
+
+	resp, err := quotaAPIDo("GET", *addr, "/quota", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	if *asJSON {
+		_, err = os.Stdout.ReadFrom(resp.Body)
+		return err
+	}
+	var list []smallprox.QuotaUsage
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	format := func(used, quota int64) string {
+		s := humanize.IBytes(uint64(used))
+		if quota > 0 {
+			s += " / " + humanize.IBytes(uint64(quota))
+		}
+		return s
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CLIENT\tTODAY\tTHIS MONTH\tEXCEEDED\n")
+	for _, u := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\n", u.Client,
+			format(u.DayBytes, u.Quota.Daily), format(u.MonthBytes, u.Quota.Monthly), u.Exceeded)
+	}
+	return tw.Flush()
+}
+
+func runQuotaReset(args []string) error {
+	fs := flag.NewFlagSet("quota reset", flag.ExitOnError)
+	addr := fs.String("proxy", ":8080", "Proxy address, as in -addr")
+	all := fs.Bool("all", false, "Reset all clients")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s quota reset: [flags] <user-or-ip>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	client := fs.Arg(0)
+	if (client == "") == !*all || fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected a client, or -all")
+	}
+
+	resp, err := quotaAPIDo("POST", *addr, "/quota/reset", url.Values{"client": {client}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return apiError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/millerlogic/smallprox"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// rateLimits adds the -clientRate and -hostRateLimit values to limits.
+func rateLimits(limits *smallprox.RateLimits, clientRates, hostRates []string) error {
+	for _, x := range clientRates {
+		client, value, err := splitHostsValue(x)
+		if err != nil {
+			return fmt.Errorf("-clientRate: %w", err)
+		}
+		var rate bytesFlag
+		if err := rate.Set(value); err != nil {
+			return fmt.Errorf("-clientRate %s: %w", x, err)
+		}
+		if limits.Clients == nil {
+			limits.Clients = make(map[string]int64)
+		}
+		limits.Clients[client] = int64(rate)
+	}
+	for _, x := range hostRates {
+		hosts, value, err := splitHostsValue(x)
+		if err != nil {
+			return fmt.Errorf("-hostRateLimit: %w", err)
+		}
+		var rate bytesFlag
+		if err := rate.Set(value); err != nil {
+			return fmt.Errorf("-hostRateLimit %s: %w", x, err)
+		}
+		limits.Hosts = append(limits.Hosts, smallprox.HostRateLimit{
+			Hosts: strings.Split(hosts, ","),
+			Rate:  int64(rate),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/millerlogic/smallprox"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// upstreamTLSRules builds the rules from the -upstreamCA, -upstreamPin and -insecureHost flags.
+// Values for the same hosts are combined into one rule.
+func upstreamTLSRules(upstreamCAs, upstreamPins, insecureHosts []string) ([]smallprox.UpstreamTLSRule, error) {
+	var rules []smallprox.UpstreamTLSRule
+	index := map[string]int{}
+	getRule := func(hosts string) *smallprox.UpstreamTLSRule {
+		hosts = strings.ToLower(hosts)
+		i, ok := index[hosts]
+		if !ok {
+			i = len(rules)
+			index[hosts] = i
+			rules = append(rules, smallprox.UpstreamTLSRule{Hosts: strings.Split(hosts, ",")})
+		}
+		return &rules[i]
+	}
+	for _, x := range upstreamCAs {
+		hosts, fp, err := splitHostsValue(x)
+		if err != nil {
+			return nil, fmt.Errorf("-upstreamCA error: %w", err)
+		}
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, fmt.Errorf("-upstreamCA error: %w", err)
+		}
+		rule := getRule(hosts)
+		if rule.RootCAs == nil {
+			rule.RootCAs = x509.NewCertPool()
+		}
+		if !rule.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("-upstreamCA error: no certificates found in %s", fp)
+		}
+	}
+	for _, x := range upstreamPins {
+		hosts, pin, err := splitHostsValue(x)
+		if err != nil {
+			return nil, fmt.Errorf("-upstreamPin error: %w", err)
+		}
+		rule := getRule(hosts)
+		rule.Pins = append(rule.Pins, pin)
+	}
+	for _, hosts := range insecureHosts {
+		getRule(hosts).SkipVerify = true
+	}
+	return rules, nil
+}
+
+func splitHostsValue(x string) (string, string, error) {
+	ieq := strings.IndexByte(x, '=')
+	if ieq <= 0 || ieq == len(x)-1 {
+		return "", "", fmt.Errorf("expected host=value, not %s", x)
+	}
+	return x[:ieq], x[ieq+1:], nil
+}
@@ -12,62 +12,140 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/exp/errors/fmt"
 )
 
+// DefaultCompressEncodings is the default CompressResponder encoding preference.
+var DefaultCompressEncodings = []string{"zstd", "br", "gzip", "deflate"}
+
+// DefaultZstdLevel is the default CompressResponder zstd level.
+const DefaultZstdLevel = 3
+
 type CompressResponder struct {
 	toggle
+	zstdLevel int32 // atomic
+	mx        sync.RWMutex
+	encodings []string
 }
 
-func (er *CompressResponder) Response(req *http.Request, resp *http.Response) *http.Response {
-	if !er.Enabled() {
-		return resp
+// ZstdLevel returns the zstd compression level, 1 (fastest) to 22.
+func (er *CompressResponder) ZstdLevel() int {
+	level := int(atomic.LoadInt32(&er.zstdLevel))
+	if level == 0 {
+		return DefaultZstdLevel
+	}
+	return level
+}
+
+// SetZstdLevel sets the zstd compression level, 1 (fastest) to 22, or 0 for DefaultZstdLevel
+func (er *CompressResponder) SetZstdLevel(level int) {
+	atomic.StoreInt32(&er.zstdLevel, int32(level))
+}
+
+// Encodings returns the output encodings in order of preference.
+func (er *CompressResponder) Encodings() []string {
+	er.mx.RLock()
+	defer er.mx.RUnlock()
+	if er.encodings == nil {
+		return DefaultCompressEncodings
 	}
-	acceptEncs := req.Header["Accept-Encoding"]
-	canBrotli := HasAnyHeaderValuePart(acceptEncs, "br")
-	canGzip := HasAnyHeaderValuePart(acceptEncs, "gzip")
-	canDeflate := HasAnyHeaderValuePart(acceptEncs, "deflate")
-	if canBrotli || canGzip || canDeflate {
-		respContentType := resp.Header.Get("Content-Type")
-		respMIMEType := respContentType
-		{
-			isem := strings.IndexByte(respMIMEType, ';')
-			if isem != -1 {
-				respMIMEType = respMIMEType[:isem]
+	return er.encodings
+}
+
+// SetEncodings sets the output encodings in order of preference,
+// any of zstd, br, gzip and deflate; nil for DefaultCompressEncodings
+func (er *CompressResponder) SetEncodings(encodings []string) error {
+	var encs []string
+	if encodings != nil {
+		encs = make([]string, 0, len(encodings))
+		for _, enc := range encodings {
+			enc = strings.ToLower(strings.TrimSpace(enc))
+			if _, ok := compressEncoders[enc]; !ok {
+				return fmt.Errorf("unsupported compression encoding: %s", enc)
 			}
+			encs = append(encs, enc)
+		}
+	}
+	er.mx.Lock()
+	er.encodings = encs
+	er.mx.Unlock()
+	return nil
+}
+
+func (er *CompressResponder) Response(req *http.Request, resp *http.Response) *http.Response {
+	return ApplyStream(resp, er.StreamResponse(req, resp))
+}
+
+// StreamResponse implements StreamResponder
+func (er *CompressResponder) StreamResponse(req *http.Request, resp *http.Response) StreamTransform {
+	if !er.Enabled() || !canTransform(req, resp) {
+		return nil
+	}
+	respContentType := resp.Header.Get("Content-Type")
+	respMIMEType := respContentType
+	{
+		isem := strings.IndexByte(respMIMEType, ';')
+		if isem != -1 {
+			respMIMEType = respMIMEType[:isem]
 		}
-		if strings.HasPrefix(respMIMEType, "text/") ||
-			respMIMEType == "application/javascript" ||
-			respMIMEType == "application/json" ||
-			strings.HasSuffix(respMIMEType, "+xml") ||
-			strings.HasSuffix(respMIMEType, "+json") {
-			if compressCheck(resp) {
-				outbuf := &Mutable{}
-				var dest io.WriteCloser
-				var enc string
-				if canBrotli {
-					dest = brotli.NewWriterLevel(outbuf, brotli.DefaultCompression)
-					enc = "br"
-				} else if canGzip {
-					// https://blog.klauspost.com/go-gzipdeflate-benchmarks/
-					dest, _ = gzip.NewWriterLevel(outbuf, 5)
-					enc = "gzip"
-				} else if canDeflate {
-					// https://blog.klauspost.com/go-gzipdeflate-benchmarks/
-					dest, _ = flate.NewWriter(outbuf, 5)
-					enc = "deflate"
+	}
+	if strings.HasPrefix(respMIMEType, "text/") ||
+		respMIMEType == "application/javascript" ||
+		respMIMEType == "application/json" ||
+		strings.HasSuffix(respMIMEType, "+xml") ||
+		strings.HasSuffix(respMIMEType, "+json") {
+		addVary(resp.Header, "Accept-Encoding") // Even if not compressed for this client.
+		enc := NegotiateContentEncoding(req.Header["Accept-Encoding"], er.Encodings())
+		if enc != "" && enc != "identity" && compressCheck(resp) {
+			newWriter := compressEncoders[enc]
+			zstdLevel := er.ZstdLevel()
+			resp.Header.Set("Content-Encoding", enc)
+			return func(w io.Writer, r io.Reader) error {
+				dest, err := newWriter(w, zstdLevel)
+				if err != nil {
+					return err
+				}
+				// Flush what's compressed so far while waiting for more input.
+				// Hide any ReadFrom, it must not be flushed during a read.
+				_, err = io.Copy(struct{ io.Writer }{dest}, &flushReader{r: r, flush: dest.Flush})
+				if err != nil {
+					return err
 				}
-				io.Copy(dest, resp.Body)
-				dest.Close() // Finish the compression.
-				resp.Body.Close()
-				resp.Body = outbuf
-				resp.Header.Set("Content-Encoding", enc)
-				// TODO: Content-Length ....
+				return dest.Close() // Finish the compression.
 			}
 		}
 	}
-	return resp
+	return nil
+}
+
+// compressWriter is implemented by the compression writers.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressEncoders are the supported output encodings.
+var compressEncoders = map[string]func(w io.Writer, zstdLevel int) (compressWriter, error){
+	"zstd": func(w io.Writer, zstdLevel int) (compressWriter, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)),
+			zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+	},
+	"br": func(w io.Writer, zstdLevel int) (compressWriter, error) {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	},
+	"gzip": func(w io.Writer, zstdLevel int) (compressWriter, error) {
+		// https://blog.klauspost.com/go-gzipdeflate-benchmarks/
+		return gzip.NewWriterLevel(w, 5)
+	},
+	"deflate": func(w io.Writer, zstdLevel int) (compressWriter, error) {
+		// https://blog.klauspost.com/go-gzipdeflate-benchmarks/
+		return flate.NewWriter(w, 5)
+	},
 }
 
 func compressCheck(resp *http.Response) bool {
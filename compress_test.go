@@ -0,0 +1,61 @@
+package smallprox
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressEncodings(t *testing.T) {
+	input := strings.Repeat("<p>hello world</p>\n", 100)
+	tests := []struct {
+		encodings      []string
+		acceptEncoding string
+		expect         string
+	}{
+		{nil, "gzip, deflate, br, zstd", "zstd"},
+		{nil, "gzip, deflate, br", "br"},
+		{nil, "deflate", "deflate"},
+		{[]string{"gzip", "zstd"}, "gzip, deflate, br, zstd", "gzip"},
+		{[]string{"br"}, "gzip", ""},
+	}
+	for _, tt := range tests {
+		er := &CompressResponder{}
+		er.SetZstdLevel(1)
+		if err := er.SetEncodings(tt.encodings); err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {"text/html"}},
+			Body:   ioutil.NopCloser(strings.NewReader(input)),
+		}
+		resp = er.Response(req, resp)
+		enc := resp.Header.Get("Content-Encoding")
+		if enc != tt.expect {
+			t.Errorf("%v %q: expected %q, got %q", tt.encodings, tt.acceptEncoding, tt.expect, enc)
+			continue
+		}
+		var r io.Reader = resp.Body
+		if enc != "" {
+			dec, err := contentDecoders[enc](resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = dec
+		}
+		output, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %s", enc, err)
+		} else if string(output) != input {
+			t.Errorf("%s: did not get the input back", enc)
+		}
+	}
+
+	if err := (&CompressResponder{}).SetEncodings([]string{"lzma"}); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// upstreamAcceptEncoding is the Accept-Encoding sent upstream, the encodings decodeResponse supports.
+const upstreamAcceptEncoding = "gzip, deflate, br, zstd"
+
+// decodeResponse decodes the body according to its Content-Encoding,
+// so the responders see the plain content; the encoding for the client is chosen later.
+// Returns an error if an encoding is not supported, in which case resp is not changed.
+func decodeResponse(req *http.Request, resp *http.Response) error {
+	var encs []string
+	for _, x := range resp.Header["Content-Encoding"] {
+		for _, enc := range strings.Split(x, ",") {
+			enc = strings.ToLower(strings.TrimSpace(enc))
+			if enc == "" || enc == "identity" {
+				continue
+			}
+			if _, ok := contentDecoders[enc]; !ok {
+				return fmt.Errorf("unsupported Content-Encoding: %s", enc)
+			}
+			encs = append(encs, enc)
+		}
+	}
+	if len(encs) != 0 && resp.StatusCode == http.StatusPartialContent {
+		return errors.New("partial content can't be decoded")
+	}
+	resp.Header.Del("Content-Encoding")
+	if len(encs) == 0 {
+		return nil
+	}
+	encodedLength := resp.ContentLength
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	if req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil // No body.
+	}
+	body := &decodeBody{src: resp.Body, encodedLength: encodedLength}
+	var r io.Reader = resp.Body
+	for i := len(encs) - 1; i >= 0; i-- { // Decode in the reverse order they were applied.
+		r = &lazyDecoder{r: r, body: body, newDecoder: contentDecoders[encs[i]]}
+	}
+	body.Reader = r
+	resp.Body = body
+	return nil
+}
+
+// contentDecoders are the supported content encodings.
+// The returned io.Reader is closed if it implements io.Closer or Close().
+var contentDecoders = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		// Should be zlib, but some servers send raw deflate.
+		pr := newPeekCloser(ioutil.NopCloser(r))
+		hdr, _ := pr.Peek(2)
+		if len(hdr) == 2 && hdr[0]&0x0f == 8 && (uint(hdr[0])<<8|uint(hdr[1]))%31 == 0 {
+			return zlib.NewReader(pr)
+		}
+		return flate.NewReader(pr), nil
+	},
+	"br": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+	"zstd": func(r io.Reader) (io.Reader, error) {
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(128<<20))
+	},
+}
+
+// upstreamContentLength returns the Content-Length of resp as received from upstream, before decoding.
+// -1 if unknown, or if a responder already replaced the decoded body.
+func upstreamContentLength(resp *http.Response) int64 {
+	if body, ok := resp.Body.(*decodeBody); ok {
+		return body.encodedLength
+	}
+	return resp.ContentLength
+}
+
+// decodeBody is the decoded body, closing it closes the decoders and the original body.
+type decodeBody struct {
+	io.Reader
+	src           io.Closer
+	encodedLength int64 // The Content-Length from upstream, -1 if unknown.
+	mx            sync.Mutex
+	closers       []func()
+	closed        bool
+}
+
+func (body *decodeBody) Close() error {
+	body.mx.Lock()
+	closers := body.closers
+	body.closers = nil
+	body.closed = true
+	body.mx.Unlock()
+	for _, c := range closers {
+		c()
+	}
+	return body.src.Close()
+}
+
+// addCloser adds a decoder to close, or closes it now if already closed.
+func (body *decodeBody) addCloser(c func()) {
+	body.mx.Lock()
+	closed := body.closed
+	if !closed {
+		body.closers = append(body.closers, c)
+	}
+	body.mx.Unlock()
+	if closed {
+		c()
+	}
+}
+
+// lazyDecoder creates the decoder on the first read,
+// so errors are returned from Read and the decoder doesn't block the responders.
+type lazyDecoder struct {
+	r          io.Reader
+	body       *decodeBody
+	newDecoder func(r io.Reader) (io.Reader, error)
+	dec        io.Reader
+	err        error
+}
+
+func (ld *lazyDecoder) Read(p []byte) (int, error) {
+	if ld.dec == nil {
+		if ld.err != nil {
+			return 0, ld.err
+		}
+		ld.dec, ld.err = ld.newDecoder(ld.r)
+		if ld.err != nil {
+			ld.dec = nil
+			return 0, ld.err
+		}
+		switch c := ld.dec.(type) {
+		case io.Closer:
+			ld.body.addCloser(func() { c.Close() })
+		case interface{ Close() }:
+			ld.body.addCloser(c.Close)
+		}
+	}
+	return ld.dec.Read(p)
+}
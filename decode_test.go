@@ -0,0 +1,88 @@
+package smallprox
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	const input = "<html><body>Hello, hello, hello world!</body></html>"
+	encoders := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"br":      func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	encode := func(data []byte, enc string) []byte {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		if enc == "rawdeflate" {
+			w, _ = flate.NewWriter(buf, 5)
+		} else {
+			w = encoders[enc](buf)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		header string
+		body   []byte
+	}{
+		{"gzip", encode([]byte(input), "gzip")},
+		{"deflate", encode([]byte(input), "deflate")},
+		{"deflate", encode([]byte(input), "rawdeflate")},
+		{"br", encode([]byte(input), "br")},
+		{"zstd", encode([]byte(input), "zstd")},
+		{"gzip, br", encode(encode([]byte(input), "gzip"), "br")},
+		{"identity", []byte(input)},
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Encoding": {tt.header}, "Content-Length": {"1"}},
+			ContentLength: 1,
+			Body:          ioutil.NopCloser(bytes.NewReader(tt.body)),
+		}
+		if err := decodeResponse(req, resp); err != nil {
+			t.Errorf("%s: %s", tt.header, err)
+			continue
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: Content-Encoding not removed", tt.header)
+		}
+		output, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %s", tt.header, err)
+		} else if string(output) != input {
+			t.Errorf("%s: got %q", tt.header, output)
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": {"gzip, foo"}},
+		Body:       ioutil.NopCloser(strings.NewReader("foo")),
+	}
+	if err := decodeResponse(req, resp); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip, foo" {
+		t.Error("Expected the response to be unchanged")
+	}
+}
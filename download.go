@@ -0,0 +1,187 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// downloadTokenParam is the query parameter of the one-time "download anyway" link.
+const downloadTokenParam = "smallprox-download"
+
+// downloadGrantTTL is how long a "download anyway" link can be used.
+const downloadGrantTTL = 10 * time.Minute
+
+// DownloadConfirmResponder stops downloads larger than the limit with a page to confirm them,
+// from the Content-Length from upstream and the Content-Type before the body is read.
+// The page has a one-time "download anyway" link for the URL and client,
+// add it as a Requester too so the link's token isn't sent upstream.
+type DownloadConfirmResponder struct {
+	limit  int64 // atomic
+	mx     sync.Mutex
+	grants map[string]downloadGrant // by token
+}
+
+type downloadGrant struct {
+	url     string
+	client  string
+	expires time.Time
+}
+
+func (er *DownloadConfirmResponder) Limit() int64 {
+	return atomic.LoadInt64(&er.limit)
+}
+
+// SetLimit sets the size above which downloads need confirmation, 0 to disable.
+func (er *DownloadConfirmResponder) SetLimit(limitBytes int64) {
+	atomic.StoreInt64(&er.limit, limitBytes)
+}
+
+// Request removes the "download anyway" token from the upstream request.
+func (er *DownloadConfirmResponder) Request(req *http.Request) (*http.Request, *http.Response) {
+	u, token := splitDownloadToken(req.URL)
+	if token == "" {
+		return req, nil
+	}
+	newReq := req.WithContext(req.Context())
+	newReq.URL = u
+	return newReq, nil
+}
+
+func (er *DownloadConfirmResponder) Response(req *http.Request, resp *http.Response) *http.Response {
+	limitBytes := er.Limit()
+	size := upstreamContentLength(resp) // What crosses the link, even if encoded.
+	if limitBytes <= 0 || req.Method != "GET" || req.Header.Get("Range") != "" ||
+		resp.StatusCode != http.StatusOK || size <= limitBytes || !isDownload(resp.Header) {
+		return resp
+	}
+	client := ""
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		client = info.clientKey()
+	}
+	u, token := splitDownloadToken(req.URL)
+	now := time.Now()
+	if token != "" && er.useGrant(token, u.String(), client, now) {
+		return resp
+	}
+	token, err := er.newGrant(u.String(), client, now)
+	if err != nil {
+		return resp // Can't confirm, so don't stop it.
+	}
+	resp.Body.Close()
+	link := *u
+	if link.RawQuery != "" {
+		link.RawQuery += "&"
+	}
+	link.RawQuery += downloadTokenParam + "=" + token
+	return newHTMLResponse(req, http.StatusForbidden, "Download Needs Confirmation", downloadConfirmTemplate, struct {
+		URL         string
+		Link        string
+		ContentType string
+		Size        string
+		Limit       string
+	}{u.String(), link.String(), resp.Header.Get("Content-Type"),
+		humanize.IBytes(uint64(size)), humanize.IBytes(uint64(limitBytes))})
+}
+
+// newGrant returns a new token to download the URL for the client.
+func (er *DownloadConfirmResponder) newGrant(rawurl, client string, now time.Time) (string, error) {
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(rnd[:])
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	if er.grants == nil {
+		er.grants = make(map[string]downloadGrant)
+	}
+	for t, grant := range er.grants {
+		if now.After(grant.expires) {
+			delete(er.grants, t)
+		}
+	}
+	er.grants[token] = downloadGrant{rawurl, client, now.Add(downloadGrantTTL)}
+	return token, nil
+}
+
+// useGrant returns true if the token allows the client to download the URL, only once.
+func (er *DownloadConfirmResponder) useGrant(token, rawurl, client string, now time.Time) bool {
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	grant, ok := er.grants[token]
+	if !ok || grant.url != rawurl || grant.client != client {
+		return false
+	}
+	delete(er.grants, token)
+	return !now.After(grant.expires)
+}
+
+// splitDownloadToken returns the URL without the "download anyway" token, and the token.
+// The rest of the query is left as is, in case it's signed.
+func splitDownloadToken(u *url.URL) (*url.URL, string) {
+	if !strings.Contains(u.RawQuery, downloadTokenParam+"=") {
+		return u, ""
+	}
+	var token string
+	var rest []string
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		if strings.HasPrefix(part, downloadTokenParam+"=") {
+			token = part[len(downloadTokenParam)+1:]
+		} else {
+			rest = append(rest, part)
+		}
+	}
+	newu := *u
+	newu.RawQuery = strings.Join(rest, "&")
+	return &newu, token
+}
+
+// isDownload returns true if the response looks like a download rather than part of a page.
+func isDownload(header http.Header) bool {
+	if strings.HasPrefix(strings.ToLower(header.Get("Content-Disposition")), "attachment") {
+		return true
+	}
+	mimeType := header.Get("Content-Type")
+	if isem := strings.IndexByte(mimeType, ';'); isem != -1 {
+		mimeType = mimeType[:isem]
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	switch {
+	case mimeType == "",
+		strings.HasPrefix(mimeType, "audio/"),
+		strings.HasPrefix(mimeType, "video/"):
+		return true
+	case strings.HasPrefix(mimeType, "application/"):
+		return !strings.Contains(mimeType, "script") &&
+			!strings.HasSuffix(mimeType, "json") &&
+			!strings.HasSuffix(mimeType, "xml") &&
+			mimeType != "application/wasm"
+	}
+	return false
+}
+
+var downloadConfirmTemplate = template.Must(template.New("downloadConfirm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Large download</title></head>
+<body>
+<h1>Large download</h1>
+<p>The proxy stopped this {{with .ContentType}}<b>{{.}}</b> {{end}}download of <b>{{.Size}}</b>, which is over {{.Limit}}:</p>
+<pre>{{.URL}}</pre>
+<p><a href="{{.Link}}">Download anyway</a></p>
+<p>The link can be used once, within 10 minutes.</p>
+</body></html>
+`))
@@ -0,0 +1,76 @@
+package smallprox
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDownloadConfirm(t *testing.T) {
+	er := &DownloadConfirmResponder{}
+	er.SetLimit(100)
+
+	respond := func(rawurl, client string, contentType string, contentLength int64) *http.Response {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		req = req.WithContext(withRequestInfo(context.Background(), &RequestInfo{ClientAddr: client + ":1234"}))
+		newReq, _ := er.Request(req)
+		if strings.Contains(newReq.URL.RawQuery, downloadTokenParam) {
+			t.Errorf("Expected the token removed from the upstream request: %s", newReq.URL)
+		}
+		return er.Response(req, &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {contentType}},
+			ContentLength: contentLength,
+			Body:          ioutil.NopCloser(strings.NewReader("")),
+		})
+	}
+
+	const fileURL = "http://example.com/file.iso?b=2&a=1"
+	if resp := respond(fileURL, "1.2.3.4", "application/octet-stream", 100); resp.StatusCode != 200 {
+		t.Errorf("Expected a download at the limit, got %d", resp.StatusCode)
+	}
+	if resp := respond(fileURL, "1.2.3.4", "text/html", 1000); resp.StatusCode != 200 {
+		t.Errorf("Expected a large page, got %d", resp.StatusCode)
+	}
+	resp := respond(fileURL, "1.2.3.4", "application/octet-stream", 1000)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the confirmation page, got %d", resp.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	m := regexp.MustCompile(`href="([^"]+)"`).FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("No link in the confirmation page: %s", body)
+	}
+	link := strings.Replace(string(m[1]), "&amp;", "&", -1)
+	if !strings.HasPrefix(link, fileURL+"&"+downloadTokenParam+"=") {
+		t.Fatalf("Unexpected link: %s", link)
+	}
+
+	if resp := respond(link, "5.6.7.8", "application/octet-stream", 1000); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the link refused for another client, got %d", resp.StatusCode)
+	}
+	if resp := respond(link, "1.2.3.4", "application/octet-stream", 1000); resp.StatusCode != 200 {
+		t.Errorf("Expected the download allowed, got %d", resp.StatusCode)
+	}
+	if resp := respond(link, "1.2.3.4", "application/octet-stream", 1000); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the link to only work once, got %d", resp.StatusCode)
+	}
+
+	// An encoded download is decoded first, its size is what comes from upstream.
+	req, _ := http.NewRequest("GET", "http://example.com/big.tar", nil)
+	enc := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {"application/x-tar"}, "Content-Encoding": {"gzip"}, "Content-Length": {"1000"}},
+		ContentLength: 1000,
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+	}
+	if err := decodeResponse(req, enc); err != nil {
+		t.Fatal(err)
+	}
+	if resp := er.Response(req, enc); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the confirmation page for an encoded download, got %d", resp.StatusCode)
+	}
+}
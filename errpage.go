@@ -0,0 +1,145 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// roundTrip is the goproxy RoundTripper, it turns upstream errors into error responses
+// so the client gets an explanation, even within HTTPS MITM.
+func (proxy *Proxy) roundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	if proxy.isOffline() {
+		return offlineResponse(req), nil
+	}
+	// Accept what the proxy can decode, the client's Accept-Encoding is used for the response.
+	// Ranges are of the encoded content, so only request those unencoded.
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		outreq.Header[k] = v
+	}
+	if req.Header.Get("Range") != "" {
+		outreq.Header.Set("Accept-Encoding", "identity")
+	} else {
+		outreq.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+	}
+	rd := getReqData(ctx)
+	resp, err := proxy.server.Tr.RoundTrip(outreq)
+	if err != nil {
+		log.Printf("Error during round trip: %+v", err)
+		if !proxy.IsHostBlocked(req.URL.Hostname()) {
+			if cached := proxy.cacheStaleIfError(req, rd); cached != nil {
+				return cached, nil
+			}
+		}
+		return errorResponse(req, err), nil
+	}
+	if buckets := proxy.shaper.getBuckets(fromUpstream, rd.clientKey(), req.URL.Hostname()); len(buckets) != 0 {
+		resp.Body = &shapedReader{resp.Body, req.Context(), buckets}
+	}
+	if resp.StatusCode >= 500 && resp.StatusCode <= 504 {
+		if cached := proxy.cacheStaleIfError(req, rd); cached != nil {
+			resp.Body.Close()
+			return cached, nil
+		}
+	}
+	return resp, nil
+}
+
+// errorResponse returns a response explaining the upstream error.
+func errorResponse(req *http.Request, err error) *http.Response {
+	var tlsErr *UpstreamTLSError
+	if errors.As(err, &tlsErr) {
+		return newHTMLResponse(req, 526, "Invalid SSL Certificate", upstreamTLSErrorTemplate, tlsErr)
+	}
+	var status int
+	var statusText string
+	xerr := err
+	if netoperr, ok := xerr.(*net.OpError); ok {
+		xerr = netoperr.Err // Unwrap
+	}
+	if _, ok := xerr.(*net.DNSError); ok {
+		status = 521
+		statusText = "Down"
+	} else {
+		status = http.StatusBadGateway
+		statusText = http.StatusText(status)
+	}
+	return &http.Response{
+		Request:    req,
+		Header:     make(http.Header),
+		StatusCode: status,
+		Status:     fmt.Sprintf("%v %v", status, statusText),
+		Body:       ioutil.NopCloser(bytes.NewBufferString(statusText)),
+	}
+}
+
+// offlineResponse is the response for requests which aren't cached in offline mode.
+func offlineResponse(req *http.Request) *http.Response {
+	return newHTMLResponse(req, http.StatusGatewayTimeout, "Offline", offlineTemplate, cacheURL(req))
+}
+
+// newHTMLResponse returns a text/html response from the template.
+func newHTMLResponse(req *http.Request, status int, statusText string, tmpl *template.Template, data interface{}) *http.Response {
+	body := &Mutable{}
+	err := tmpl.Execute(body, data)
+	if err != nil {
+		log.Printf("Error in %s template: %s", tmpl.Name(), err)
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		Request:       req,
+		Header:        header,
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%v %v", status, statusText),
+		Body:          body,
+		ContentLength: int64(body.Len()),
+	}
+}
+
+var upstreamTLSErrorTemplate = template.Must(template.New("upstreamTLSError").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Invalid upstream certificate</title></head>
+<body>
+<h1>Invalid upstream certificate</h1>
+<p>The proxy did not connect to <b>{{.Host}}</b> because its certificate was rejected:</p>
+<pre>{{.Err}}</pre>
+<p>The site may be misconfigured, or the connection may have been intercepted.
+If this is an internal or lab host, the proxy administrator can add its CA, a pin, or an exception for it.</p>
+</body></html>
+`))
+
+var offlineTemplate = template.Must(template.New("offline").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Offline</title></head>
+<body>
+<h1>Offline</h1>
+<p>The proxy is in offline mode and does not have this page cached:</p>
+<pre>{{.}}</pre>
+<p>Only pages visited while online are available until offline mode is turned off.</p>
+</body></html>
+`))
+
+var overLimitTemplate = template.Must(template.New("overLimit").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Content too large</title></head>
+<body>
+<h1>Content too large</h1>
+<p>The proxy did not send this {{with .ContentType}}<b>{{.}}</b> {{end}}content because it is larger than its limit of {{.Limit}}:</p>
+<pre>{{.URL}}</pre>
+</body></html>
+`))
@@ -1,6 +1,6 @@
 module github.com/millerlogic/smallprox
 
-go 1.12
+go 1.15
 
 require (
 	github.com/andybalholm/brotli v0.0.0-20190821151343-b60f0d972eeb
@@ -9,10 +9,11 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/elazarl/goproxy v0.0.0-20190711103511-473e67f1d7d2
 	github.com/elazarl/goproxy/ext v0.0.0-20190711103511-473e67f1d7d2
+	github.com/klauspost/compress v1.11.13
 	github.com/tdewolff/parse v2.3.4+incompatible
 	github.com/tdewolff/test v1.0.3 // indirect
-	github.com/youmark/pkcs8 v0.0.0-20181201043747-70daafe5d78a
-	golang.org/x/crypto v0.0.0-20190820162420-60c769a6c586 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a
 	golang.org/x/exp/errors v0.0.0-20190731235908-ec7cb31e5a56
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
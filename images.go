@@ -8,26 +8,120 @@ package smallprox
 
 import (
 	"bytes"
+	"image"
+	"image/draw"
 	"image/jpeg"
-
+	"image/png"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"golang.org/x/exp/errors"
 	"golang.org/x/exp/errors/fmt"
 )
 
+// ImageShrinkOptions are the parameters of ImageShrinkResponder.
+type ImageShrinkOptions struct {
+	Disabled        bool  // Leave the images as is, such as for a host.
+	MaxDimension    int   // Max width and height, larger images are scaled down.
+	WebPQuality     int   // 1 to 100
+	JPEGQuality     int   // 1 to 100
+	MinSize         int64 // Images smaller than this many bytes are left as is.
+	Grayscale       bool
+	ProgressiveJPEG bool // Requires jpegtran, see CheckProgressiveJPEG.
+
+	Animated             AnimationMode // Animated GIF and WebP images.
+	AnimatedMaxFrames    int           // Max frames of re-encoded animations, 0 for all.
+	AnimatedMaxDimension int           // Max width and height of re-encoded animations, 0 for MaxDimension.
+}
+
+// DefaultImageShrinkOptions are the options of a new ImageShrinkResponder.
+// WebP is given a lower quality than JPEG, as it looks better at the same quality,
+// see https://developers.google.com/speed/webp/docs/webp_study
+var DefaultImageShrinkOptions = ImageShrinkOptions{
+	MaxDimension: 1024,
+	WebPQuality:  10,
+	JPEGQuality:  20,
+
+	AnimatedMaxFrames:    30,
+	AnimatedMaxDimension: 320,
+}
+
+// ImageShrinkHostOptions are the options of ImageShrinkResponder for destination hosts.
+type ImageShrinkHostOptions struct {
+	Hosts   []string // Host names, "*.example.com" or ".example.com" also match subdomains.
+	Options ImageShrinkOptions
+}
+
+// savingsImageMaxDimension is the max width and height for RequestInfo.Savings
+const savingsImageMaxDimension = 512
+
 type ImageShrinkResponder struct {
 	toggle
+	timeBudget
+	mx          sync.RWMutex
+	opts        *ImageShrinkOptions // nil for DefaultImageShrinkOptions
+	hostOptions []ImageShrinkHostOptions
+}
+
+// Options returns the options for hosts without host options.
+func (er *ImageShrinkResponder) Options() ImageShrinkOptions {
+	er.mx.RLock()
+	defer er.mx.RUnlock()
+	if er.opts == nil {
+		return DefaultImageShrinkOptions
+	}
+	return *er.opts
+}
+
+func (er *ImageShrinkResponder) SetOptions(opts ImageShrinkOptions) {
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	er.opts = &opts
+}
+
+// SetHostOptions sets the options for destination hosts, the first match applies.
+func (er *ImageShrinkResponder) SetHostOptions(hostOptions []ImageShrinkHostOptions) {
+	hostOptions = append([]ImageShrinkHostOptions(nil), hostOptions...)
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	er.hostOptions = hostOptions
+}
+
+// OptionsFor returns the options for the destination host.
+func (er *ImageShrinkResponder) OptionsFor(host string) ImageShrinkOptions {
+	er.mx.RLock()
+	for _, rule := range er.hostOptions {
+		for _, pattern := range rule.Hosts {
+			if matchHostPattern(pattern, host) {
+				er.mx.RUnlock()
+				return rule.Options
+			}
+		}
+	}
+	er.mx.RUnlock()
+	return er.Options()
 }
 
 func (er *ImageShrinkResponder) Response(req *http.Request, resp *http.Response) *http.Response {
-	if !er.Enabled() {
+	if (!er.Enabled() && !savingsFor(req)) || !canTransform(req, resp) {
 		return resp
 	}
+	opts := er.OptionsFor(req.URL.Hostname())
+	if opts.Disabled || (resp.ContentLength >= 0 && resp.ContentLength < opts.MinSize) {
+		return resp
+	}
+	if savingsFor(req) && (opts.MaxDimension <= 0 || opts.MaxDimension > savingsImageMaxDimension) {
+		opts.MaxDimension = savingsImageMaxDimension
+	}
+	if savingsFor(req) && opts.Animated == AnimationPass {
+		opts.Animated = AnimationStill
+	}
 	respContentType := resp.Header.Get("Content-Type")
 	reqAccept := req.Header["Accept"]
 	if strings.HasPrefix(respContentType, "image/") &&
@@ -36,56 +130,183 @@ func (er *ImageShrinkResponder) Response(req *http.Request, resp *http.Response)
 		!strings.HasSuffix(respContentType, "+json") {
 		const webpType = "image/webp"
 		const jpegType = "image/jpeg"
-		canWebp := HasAnyHeaderValuePart(reqAccept, webpType) ||
-			(respContentType == webpType && (len(reqAccept) == 0 || HasAnyHeaderValuePart(reqAccept, "*/*")))
+		const pngType = "image/png"
+		const gifType = "image/gif"
+		// Only send webp if the client names it, or it was already webp;
+		// older browsers without webp support accept image/*
+		offers := []string{jpegType}
+		if _, specificity := acceptQuality(parseAccept(reqAccept), webpType); specificity == 3 || respContentType == webpType {
+			offers = []string{webpType, jpegType}
+		}
+		destOffer := NegotiateAccept(reqAccept, offers)
+		if destOffer == "" {
+			return resp // The client accepts none of them.
+		}
+		canWebp := destOffer == webpType
 		outbuf := &Mutable{}
+		orig, err := readBytes(resp.Body) // Kept to pass through if the time budget runs out.
+		resp.Body.Close()
+		original := func() *http.Response {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(orig))
+			resp.ContentLength = int64(len(orig))
+			return resp
+		}
+		passThrough := func() *http.Response {
+			log.Printf("Image shrinking of %s stopped: %s", req.URL, req.Context().Err())
+			return original()
+		}
+		if err == nil && int64(len(orig)) < opts.MinSize {
+			return original() // Not worth it.
+		}
+		// Decoding keeps only the first frame, so detect animations first.
+		animated := err == nil && isAnimated(orig)
+		if animated && opts.Animated == AnimationPass {
+			return original()
+		}
 		// TODO: use specific decoder per the content type...
 		//img, _, err := image.Decode(r)
-		img, err := imaging.Decode(resp.Body, imaging.AutoOrientation(true))
-		resp.Body.Close()
+		var img image.Image
+		var anim *animation
+		if err == nil {
+			switch {
+			case animated && opts.Animated == AnimationReencode:
+				maxDim := opts.AnimatedMaxDimension
+				if maxDim <= 0 {
+					maxDim = opts.MaxDimension
+				}
+				anim, err = decodeAnimation(req.Context(), orig, opts.AnimatedMaxFrames, maxDim)
+			case animated && isWebP(orig):
+				// Can't be decoded as a still, take the first frame.
+				anim, err = decodeAnimation(req.Context(), orig, 1, 0)
+				if err == nil {
+					img, anim = anim.frames[0], nil
+				}
+			default:
+				img, err = imaging.Decode(bytes.NewReader(orig), imaging.AutoOrientation(true))
+				if err == nil && isWebP(orig) {
+					img = webpDecoded(img)
+				}
+			}
+		}
+		if err == nil && req.Context().Err() != nil {
+			return passThrough()
+		}
+		if errors.Is(err, errAnimationTooLarge) {
+			return original()
+		}
 		if err != nil {
 			log.Printf("Error loading image as %s: %s", respContentType, err)
+			transformed(resp.Header)
 			resp.Body = ioutil.NopCloser(bytes.NewBuffer(badImg))
 			resp.Header.Set("Content-Type", badImgType)
 			resp.StatusCode = http.StatusInternalServerError
 			resp.Status = fmt.Sprintf("%v %v", resp.StatusCode, http.StatusText(resp.StatusCode))
 		} else {
-			const maxImgDim = 1024
-			w := img.Bounds().Dx()
-			h := img.Bounds().Dy()
-			if w > maxImgDim || h > maxImgDim {
-				var r float64
-				if w > h {
-					r = maxImgDim / float64(w)
+			destType := jpegType
+			if anim != nil {
+				if opts.Grayscale {
+					for i, frame := range anim.frames {
+						anim.frames[i] = imaging.Grayscale(frame)
+					}
+				}
+				if canWebp {
+					destType = webpType
+					err = encodeAnimatedWebP(outbuf, anim, opts.WebPQuality)
 				} else {
-					r = maxImgDim / float64(h)
+					destType = gifType
+					err = encodeAnimatedGIF(outbuf, anim)
 				}
-				w = int(float64(w) * r)
-				h = int(float64(h) * r)
-				img = imaging.Resize(img, w, h, imaging.Lanczos)
-			}
-			destType := jpegType
-			if canWebp {
-				destType = webpType
-				err = webp.Encode(outbuf, img, &webp.Options{Quality: 10})
 			} else {
-				// jpeg needs higher quality, https://developers.google.com/speed/webp/docs/webp_study
-				jpeg.Encode(outbuf, img, &jpeg.Options{Quality: 20})
+				alpha := hasAlpha(img)
+				maxImgDim := opts.MaxDimension
+				w := img.Bounds().Dx()
+				h := img.Bounds().Dy()
+				if maxImgDim > 0 && (w > maxImgDim || h > maxImgDim) {
+					var r float64
+					if w > h {
+						r = float64(maxImgDim) / float64(w)
+					} else {
+						r = float64(maxImgDim) / float64(h)
+					}
+					w = int(float64(w) * r)
+					h = int(float64(h) * r)
+					img = imaging.Resize(img, w, h, imaging.Lanczos)
+					if req.Context().Err() != nil {
+						return passThrough()
+					}
+				}
+				if opts.Grayscale && alpha {
+					img = imaging.Grayscale(img)
+				} else if opts.Grayscale {
+					gray := image.NewGray(img.Bounds())
+					draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+					img = gray
+				}
+				switch {
+				case canWebp:
+					destType = webpType
+					err = encodeWebP(outbuf, img, opts.WebPQuality, alpha)
+				case alpha:
+					// JPEG has no alpha, transparent pixels would turn black.
+					destType = pngType
+					err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(outbuf, quantize(img))
+				default:
+					err = jpeg.Encode(outbuf, img, &jpeg.Options{Quality: opts.JPEGQuality})
+					if err == nil && opts.ProgressiveJPEG {
+						if prog, perr := progressiveJPEG(req.Context(), outbuf.Bytes()); perr != nil {
+							log.Printf("Error making %s progressive, kept baseline: %s", req.URL, perr)
+						} else {
+							outbuf.Reset()
+							outbuf.Write(prog)
+						}
+					}
+				}
+			}
+			if req.Context().Err() != nil {
+				return passThrough()
 			}
 			if err != nil {
 				log.Printf("Error converting image from %s to %s: %s ", respContentType, destType, err)
+				transformed(resp.Header)
 				resp.Body = ioutil.NopCloser(bytes.NewBuffer(badImg))
 				resp.Header.Set("Content-Type", badImgType)
 				resp.StatusCode = http.StatusInternalServerError
 				resp.Status = fmt.Sprintf("%v %v", resp.StatusCode, http.StatusText(resp.StatusCode))
+			} else if outbuf.Len() >= len(orig) {
+				return original() // Not smaller.
 			} else {
+				transformed(resp.Header)
 				resp.Body = outbuf
 				resp.Header.Set("Content-Type", destType)
+				addVary(resp.Header, "Accept") // The type depends on it.
 			}
 		}
 	}
 	return resp
 }
 
+// encodeWebP encodes img with its alpha, if any.
+// chai2010/webp premultiplies the alpha, but libwebp expects it straight, so give it straight.
+func encodeWebP(w io.Writer, img image.Image, quality int, alpha bool) error {
+	if alpha {
+		nrgba := imaging.Clone(img)
+		img = &image.RGBA{Pix: nrgba.Pix, Stride: nrgba.Stride, Rect: nrgba.Rect}
+	}
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+}
+
+// isWebP returns true if data is a WebP file.
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// webpDecoded fixes an image decoded by chai2010/webp, an *image.RGBA with straight alpha.
+func webpDecoded(img image.Image) image.Image {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return &image.NRGBA{Pix: rgba.Pix, Stride: rgba.Stride, Rect: rgba.Rect}
+	}
+	return img
+}
+
 var badImg = mustDecodeStringBase64(`iVBORw0KGgoAAAANSUhEUgAAACIAAAAiCAMAAAANmfvwAAABa1BMVEUAAAAiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyIiiyKKpJssAAAAeHRSTlMAAQIDBAUGBwgJCwwNDg8SFBUWFxgZGhwdHiAhIyQmJyosLzEyNjg5Ojw9P0BBSUpMTU5RUlRWV1hZW1xdXmFjZ2xtcXR1eHl+gIOFi46Rl5qdnqCio6WmqqutsLK8wMPFx8jKzM/R09XZ2tze4uTo6fHz9ff5+/1dImJTAAABnklEQVQYGa3BaVsSYQCG0WcaoaAUFDfKNAmkXa0sK9M2K5dKNCu3ytCC0IxY5v75zQsOFyB88xydvr7pVLZQyKYe9qq15AE1uTGdNLhHRXY3j5EeUJNxXB/Hzsl15tLrEnBHDeaBzR7VnH0LzKvOBPBADWJlGFdNFIipSaQMUXn2YULyjQbkGQ5JcdjTsRuwKtl/KAVVtQiD0hIkVXUIF6QeIK6qI5iSApBTxQAsS7J2yPlU9Yh8l6QF6JcxA1dkdFryBG25RuCxjHWw1ZINazIOKKqNIr9llEirjTRFGQX21cZP/snIUFYbDhkZH8AnIzC9+KxfdfywIuMuxOW6Wca1pIqOTktKwD0ZIViRFOUwFujdYEbGJBFpDbpV8R3C0joRSVam6Jcr5XQoAr9UNQRbElkZo3zySZO8kbYhpmOfYVbXr6piFufrXzYszcE3eYJ5uCVP5NXm+5h0G5xu1VwEnqvBCyCpOgngx5BqLqeBp2rQdwTs3g/7LMsfnkoDTkJN/As02ArppK5lB8/OiFqzh5+8+7K9+vLaeZ26/w2hg7si3OgUAAAAAElFTkSuQmCC`)
 var badImgType = "image/png"
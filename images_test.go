@@ -0,0 +1,231 @@
+package smallprox
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func shrinkImage(er *ImageShrinkResponder, rawurl, accept string, data []byte) *http.Response {
+	req, _ := http.NewRequest("GET", rawurl, nil)
+	req.Header.Set("Accept", accept)
+	return er.Response(req, &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {"image/png"}},
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	})
+}
+
+func TestImageShrinkOptions(t *testing.T) {
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	opts := DefaultImageShrinkOptions
+	opts.MaxDimension = 100
+	opts.Grayscale = true
+	er.SetOptions(opts)
+	keep := opts
+	keep.Disabled = true
+	small := opts
+	small.MinSize = 1 << 20
+	er.SetHostOptions([]ImageShrinkHostOptions{
+		{Hosts: []string{".photos.example"}, Options: keep},
+		{Hosts: []string{"icons.example"}, Options: small},
+	})
+
+	data := testPNG(t, 300, 200)
+	resp := shrinkImage(er, "http://example.com/a.png", "image/*", data)
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatalf("Expected image/jpeg, got %s", ct)
+	}
+	out, _ := ioutil.ReadAll(resp.Body)
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(100, 66) {
+		t.Errorf("Expected 100x66, got %v", size)
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("Expected grayscale, got %T", img)
+	}
+
+	resp = shrinkImage(er, "http://example.com/a.png", "image/png", data)
+	out, _ = ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(out, data) {
+		t.Error("Expected the original image when JPEG and WebP aren't accepted")
+	}
+
+	for _, rawurl := range []string{"http://www.photos.example/a.png", "http://icons.example/a.png"} {
+		resp = shrinkImage(er, rawurl, "image/*", data)
+		out, _ = ioutil.ReadAll(resp.Body)
+		if resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(out, data) {
+			t.Errorf("%s: expected the original image", rawurl)
+		}
+	}
+}
+
+// transparentImage returns a circle with soft edges on a transparent background.
+func transparentImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	r := float64(w) / 3
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x-w/2), float64(y-h/2)
+			d := r - math.Sqrt(dx*dx+dy*dy)
+			if d <= 0 {
+				continue
+			}
+			a := 255
+			if d < 8 {
+				a = int(d * 32)
+			}
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 200, uint8(a)})
+		}
+	}
+	return img
+}
+
+func TestImageShrinkHeaders(t *testing.T) {
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	opts := DefaultImageShrinkOptions
+	opts.MaxDimension = 100
+	opts.MinSize = 0
+	er.SetOptions(opts)
+	shrink := func(data []byte) *http.Response {
+		req, _ := http.NewRequest("GET", "http://example.com/a.png", nil)
+		req.Header.Set("Accept", "image/*")
+		return er.Response(req, &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"image/png"}, "Etag": {`"abc"`}, "Accept-Ranges": {"bytes"}},
+			ContentLength: int64(len(data)),
+			Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		})
+	}
+	// A JPEG of a tiny PNG isn't smaller, so it's left as is.
+	if resp := shrink(testPNG(t, 2, 2)); resp.Header.Get("Content-Type") != "image/png" ||
+		resp.Header.Get("ETag") != `"abc"` || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Expected the original headers, got %v", resp.Header)
+	}
+	if resp := shrink(testPNG(t, 300, 200)); resp.Header.Get("Content-Type") != "image/jpeg" ||
+		resp.Header.Get("ETag") != `W/"abc"` || resp.Header.Get("Accept-Ranges") != "" {
+		t.Errorf("Expected transformed headers, got %v", resp.Header)
+	}
+}
+
+func TestImageShrinkTransparent(t *testing.T) {
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	opts := DefaultImageShrinkOptions
+	opts.MaxDimension = 100
+	er.SetOptions(opts)
+
+	src := transparentImage(300, 200)
+	pngbuf := &bytes.Buffer{}
+	if err := png.Encode(pngbuf, src); err != nil {
+		t.Fatal(err)
+	}
+	gifbuf := &bytes.Buffer{}
+	if err := gif.Encode(gifbuf, quantize(src), nil); err != nil {
+		t.Fatal(err)
+	}
+	webpbuf := &bytes.Buffer{}
+	if err := encodeWebP(webpbuf, src, 100, true); err != nil {
+		t.Fatal(err)
+	}
+	fixtures := map[string][]byte{"png": pngbuf.Bytes(), "gif": gifbuf.Bytes(), "webp": webpbuf.Bytes()}
+
+	for name, data := range fixtures {
+		for _, accept := range []string{"image/*", "image/webp,image/*"} {
+			resp := shrinkImage(er, "http://example.com/a."+name, accept, data)
+			out, _ := ioutil.ReadAll(resp.Body)
+			ct := resp.Header.Get("Content-Type")
+			if ct == "image/jpeg" {
+				t.Errorf("%s %s: lost transparency to image/jpeg", name, accept)
+				continue
+			}
+			if bytes.Equal(out, data) {
+				continue // Leaving the original is fine.
+			}
+			img, _, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, accept, err)
+			}
+			if ct == "image/webp" {
+				img = webpDecoded(img)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(100, 66) {
+				t.Errorf("%s %s: expected 100x66, got %v", name, accept, size)
+			}
+			if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+				t.Errorf("%s %s: expected a transparent corner, got alpha %d", name, accept, a>>8)
+			}
+			c := color.NRGBAModel.Convert(img.At(50, 33)).(color.NRGBA)
+			if c.A != 255 || absDiff(uint32(c.B), 200) > 16 {
+				t.Errorf("%s %s: expected an opaque center, got %v", name, accept, c)
+			}
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	// Few colors are kept exactly.
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			if x >= 10 {
+				src.Set(x, y, color.NRGBA{uint8(x * 10), uint8(y * 10), 0, uint8(y * 12)})
+			}
+		}
+	}
+	img := quantize(src)
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			want := src.NRGBAAt(x, y)
+			if want.A == 0 {
+				want = color.NRGBA{}
+			}
+			if got := img.At(x, y).(color.NRGBA); got != want {
+				t.Fatalf("At %d,%d: expected %v, got %v", x, y, want, got)
+			}
+		}
+	}
+
+	// Many colors fit in a palette.
+	img = quantize(transparentImage(300, 200))
+	if len(img.Palette) > 256 {
+		t.Fatalf("Expected at most 256 colors, got %d", len(img.Palette))
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Error("Expected a transparent corner")
+	}
+}
+
+func absDiff(a, b uint32) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"crypto"
+	"log"
+	"sync"
+	"time"
+)
+
+// keyPool generates private keys in the background so they're ready when needed.
+// The background generation starts on Start or the first Get.
+type keyPool struct {
+	gen      func() (crypto.Signer, error)
+	keys     chan crypto.Signer
+	start    sync.Once
+	stopc    chan struct{}
+	stopOnce sync.Once
+}
+
+func newKeyPool(size int, gen func() (crypto.Signer, error)) *keyPool {
+	return &keyPool{
+		gen:   gen,
+		keys:  make(chan crypto.Signer, size),
+		stopc: make(chan struct{}),
+	}
+}
+
+// Start the background generation, if not already started.
+func (kp *keyPool) Start() {
+	kp.start.Do(func() {
+		go kp.fill()
+	})
+}
+
+// Get returns a pregenerated key if available, otherwise generates one now.
+func (kp *keyPool) Get() (crypto.Signer, error) {
+	kp.Start()
+	select {
+	case key := <-kp.keys:
+		return key, nil
+	default:
+		return kp.gen()
+	}
+}
+
+// Stop the background generation.
+func (kp *keyPool) Stop() {
+	kp.stopOnce.Do(func() {
+		close(kp.stopc)
+	})
+}
+
+func (kp *keyPool) fill() {
+	for {
+		key, err := kp.gen()
+		if err != nil {
+			log.Printf("Unable to generate key: %s", err)
+			select {
+			case <-time.After(time.Minute):
+				continue
+			case <-kp.stopc:
+				return
+			}
+		}
+		select {
+		case kp.keys <- key:
+		case <-kp.stopc:
+			return
+		}
+	}
+}
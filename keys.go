@@ -0,0 +1,235 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// ParsePrivateKeyPEM parses the first private key in the PEM data.
+// Supports PKCS#8 (optionally encrypted), PKCS#1 and SEC1 keys for RSA, ECDSA and Ed25519.
+// password is only used if the key is encrypted.
+func ParsePrivateKeyPEM(data []byte, password []byte) (crypto.Signer, error) {
+	var block *pem.Block
+	foundPEM := false
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			if !foundPEM {
+				return nil, errors.New("no PEM data found")
+			}
+			return nil, errors.New("no private key found in PEM data")
+		}
+		foundPEM = true
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if len(password) == 0 {
+			return nil, errors.New("private key is encrypted, password required")
+		}
+		key, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) { // Legacy OpenSSL encryption.
+			if len(password) == 0 {
+				return nil, errors.New("private key is encrypted, password required")
+			}
+			der, err = x509.DecryptPEMBlock(block, password)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decrypt private key: %w", err)
+			}
+		}
+		if block.Type == "RSA PRIVATE KEY" {
+			key, err = x509.ParsePKCS1PrivateKey(der)
+		} else {
+			key, err = x509.ParseECPrivateKey(der)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", strings.ToLower(block.Type), err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// LoadCA loads a CA certificate and private key from PEM data.
+// certPEM may contain a chain: the signing CA first, followed by its issuers,
+// which are served to clients along with the MITM certificates.
+// password is only used if the key is encrypted.
+func LoadCA(certPEM, keyPEM []byte, password []byte) (tls.Certificate, error) {
+	var ca tls.Certificate
+	chain, err := parseCertificatesPEM(certPEM)
+	if err != nil {
+		return ca, err
+	}
+	if !chain[0].IsCA {
+		return ca, fmt.Errorf("certificate is not a CA: %s", chain[0].Subject)
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		err := chain[i].CheckSignatureFrom(chain[i+1])
+		if err != nil {
+			return ca, fmt.Errorf("certificate %d (%s) is not signed by the next certificate (%s): %w",
+				i+1, chain[i].Subject, chain[i+1].Subject, err)
+		}
+	}
+	if len(chain) > 1 && isSelfSigned(chain[len(chain)-1]) {
+		chain = chain[:len(chain)-1] // Clients already have the root, see LoadCARoot
+	}
+	for _, cert := range chain {
+		ca.Certificate = append(ca.Certificate, cert.Raw)
+	}
+	ca.Leaf = chain[0]
+	key, err := ParsePrivateKeyPEM(keyPEM, password)
+	if err != nil {
+		return ca, err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(ca.Leaf.PublicKey) {
+		return ca, fmt.Errorf("private key does not match certificate %s", ca.Leaf.Subject)
+	}
+	ca.PrivateKey = key
+	return ca, nil
+}
+
+// LoadCARoot returns the self-signed root at the end of the CA certificate PEM data,
+// which LoadCA leaves out of the chain, or nil if there's no root.
+func LoadCARoot(certPEM []byte) (*x509.Certificate, error) {
+	chain, err := parseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if root := chain[len(chain)-1]; isSelfSigned(root) {
+		return root, nil
+	}
+	return nil, nil
+}
+
+// parseCertificatesPEM returns the certificates in the PEM data, at least one.
+func parseCertificatesPEM(certPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	foundPEM := false
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		foundPEM = true
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse certificate %d: %w", len(chain)+1, err)
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if len(chain) == 0 {
+		if !foundPEM {
+			return nil, errors.New("no PEM data found in certificate")
+		}
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return chain, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// Key types for CAOptions.KeyType and Options.LeafKeyType
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// ParseKeyType parses a key type, rsa, ecdsa (or ec) or ed25519.
+func ParseKeyType(s string) (string, error) {
+	switch keyType := strings.ToLower(s); keyType {
+	case KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519:
+		return keyType, nil
+	case "ec":
+		return KeyTypeECDSA, nil
+	}
+	return "", fmt.Errorf("unknown key type %q, expected rsa, ecdsa or ed25519", s)
+}
+
+// newKey generates a new key of the type, rsa, ecdsa or ed25519.
+// bits is the RSA key size or the ECDSA curve size, or 0 for the default.
+func newKey(keyType string, bits int, rand io.Reader) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case KeyTypeRSA:
+		if bits == 0 {
+			bits = 2048
+		}
+		if bits < 2048 {
+			return nil, errors.New("RSA key size must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand, bits)
+	case KeyTypeECDSA, "ec":
+		switch bits {
+		case 0, 256:
+			return ecdsa.GenerateKey(elliptic.P256(), rand)
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand)
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve size %d", bits)
+		}
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+}
+
+// keyTypeOf returns the key type of the key, or empty if unknown.
+func keyTypeOf(key crypto.PrivateKey) string {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return KeyTypeRSA
+	case *ecdsa.PrivateKey:
+		return KeyTypeECDSA
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519
+	default:
+		return ""
+	}
+}
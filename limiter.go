@@ -7,14 +7,57 @@
 package smallprox
 
 import (
+	"bytes"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+
+	humanize "github.com/dustin/go-humanize"
+	"golang.org/x/exp/errors/fmt"
 )
 
+// LimitPolicy is what LimitBytesResponder does with content over the limit.
+type LimitPolicy int32
+
+const (
+	LimitTruncate    LimitPolicy = iota // Cut the content off at the limit.
+	LimitError                          // Respond with an error page explaining the limit.
+	LimitPassThrough                    // Stream the content through unlimited, not transformed by the other responders.
+)
+
+func (policy LimitPolicy) String() string {
+	switch policy {
+	case LimitTruncate:
+		return "truncate"
+	case LimitError:
+		return "error"
+	case LimitPassThrough:
+		return "passthrough"
+	}
+	return fmt.Sprintf("LimitPolicy(%d)", int32(policy))
+}
+
+// ParseLimitPolicy parses truncate, error or passthrough.
+func ParseLimitPolicy(s string) (LimitPolicy, error) {
+	for _, policy := range []LimitPolicy{LimitTruncate, LimitError, LimitPassThrough} {
+		if strings.EqualFold(s, policy.String()) {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown limit policy %q, expected truncate, error or passthrough", s)
+}
+
+// LimitBytesResponder limits the content of responses, to minimize excessive memory usage.
+// The limit applies to everything that doesn't look like a download, unless a type limit is set.
+// With LimitError or LimitPassThrough, content without a Content-Length is read up to the limit to decide.
 type LimitBytesResponder struct {
-	limit int64 // atomic
+	limit      int64 // atomic
+	policy     int32 // atomic
+	mx         sync.RWMutex
+	typeLimits map[string]int64
 }
 
 func (er *LimitBytesResponder) Limit() int64 {
@@ -25,17 +68,124 @@ func (er *LimitBytesResponder) SetLimit(limitBytes int64) {
 	atomic.StoreInt64(&er.limit, limitBytes)
 }
 
+func (er *LimitBytesResponder) Policy() LimitPolicy {
+	return LimitPolicy(atomic.LoadInt32(&er.policy))
+}
+
+func (er *LimitBytesResponder) SetPolicy(policy LimitPolicy) {
+	atomic.StoreInt32(&er.policy, int32(policy))
+}
+
+// SetTypeLimit sets the limit for a MIME type, or for all of a major type such as image/*
+// 0 is unlimited, negative removes it so the default limit applies.
+func (er *LimitBytesResponder) SetTypeLimit(mimeType string, limitBytes int64) {
+	mimeType = strings.ToLower(mimeType)
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	if limitBytes < 0 {
+		delete(er.typeLimits, mimeType)
+		return
+	}
+	if er.typeLimits == nil {
+		er.typeLimits = make(map[string]int64)
+	}
+	er.typeLimits[mimeType] = limitBytes
+}
+
+// LimitFor returns the limit for the Content-Type, 0 if unlimited.
+func (er *LimitBytesResponder) LimitFor(contentType string) int64 {
+	mimeType := contentType
+	if isem := strings.IndexByte(mimeType, ';'); isem != -1 {
+		mimeType = mimeType[:isem]
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	er.mx.RLock()
+	limit, ok := er.typeLimits[mimeType]
+	if !ok {
+		if islash := strings.IndexByte(mimeType, '/'); islash != -1 {
+			limit, ok = er.typeLimits[mimeType[:islash]+"/*"]
+		}
+	}
+	er.mx.RUnlock()
+	if ok {
+		return limit
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		return 0 // Looks like a download.
+	}
+	return er.Limit()
+}
+
 func (er *LimitBytesResponder) Response(req *http.Request, resp *http.Response) *http.Response {
-	limitBytes := er.Limit()
-	if limitBytes <= 0 {
+	limitBytes := er.LimitFor(resp.Header.Get("Content-Type"))
+	if limitBytes <= 0 || req.Method == "HEAD" ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusPartialContent { // Content-Range is of the whole.
 		return resp
 	}
-	respMIMEType := resp.Header.Get("Content-Type")
-	if respMIMEType != "" && !strings.HasPrefix(respMIMEType, "application/octet-stream") {
-		// Limit everything that doesn't look like a download.
+	if resp.ContentLength >= 0 && resp.ContentLength <= limitBytes {
+		return resp // Fits.
+	}
+	policy := er.Policy()
+	if policy == LimitTruncate && resp.ContentLength >= 0 {
+		truncated(resp, limitBytes)
 		resp.Body = &limitCloser{io.LimitedReader{R: resp.Body, N: limitBytes}}
+		return resp
+	}
+	if resp.ContentLength < 0 {
+		// Read up to the limit to know if it fits.
+		buf := &Mutable{}
+		_, err := io.Copy(buf, io.LimitReader(resp.Body, limitBytes+1))
+		if err != nil {
+			resp.Body.Close()
+			return errorResponse(req, err)
+		}
+		if int64(buf.Len()) <= limitBytes {
+			resp.Body.Close()
+			resp.Body = buf
+			return resp
+		}
+		if policy == LimitTruncate {
+			resp.Body.Close()
+			buf.Truncate(int(limitBytes))
+			truncated(resp, limitBytes)
+			resp.Body = buf
+			return resp
+		}
+		resp.Body = &passThroughBody{io.MultiReader(bytes.NewReader(buf.Bytes()), resp.Body), resp.Body}
+	}
+	if policy == LimitPassThrough {
+		if _, ok := resp.Body.(*passThroughBody); !ok {
+			resp.Body = &passThroughBody{resp.Body, resp.Body}
+		}
+		return resp
 	}
-	return resp
+	resp.Body.Close()
+	return newHTMLResponse(req, http.StatusBadGateway, http.StatusText(http.StatusBadGateway), overLimitTemplate, struct {
+		URL         string
+		ContentType string
+		Limit       string
+	}{req.URL.String(), resp.Header.Get("Content-Type"), humanize.IBytes(uint64(limitBytes))})
+}
+
+// truncatedWarning starts the Warning of content truncated by LimitTruncate, see isTruncated.
+const truncatedWarning = `199 - "Content truncated`
+
+// truncated updates the header of a response whose content is cut off at limitBytes.
+func truncated(resp *http.Response, limitBytes int64) {
+	resp.ContentLength = limitBytes
+	resp.Header.Set("Content-Length", strconv.FormatInt(limitBytes, 10))
+	resp.Header.Add("Warning", fmt.Sprintf(`%s to %s"`, truncatedWarning, humanize.IBytes(uint64(limitBytes))))
+}
+
+// isTruncated returns true if the content was truncated by LimitTruncate, it must not be cached.
+func isTruncated(header http.Header) bool {
+	for _, warning := range header["Warning"] {
+		if strings.HasPrefix(warning, truncatedWarning) {
+			return true
+		}
+	}
+	return false
 }
 
 type limitCloser struct {
@@ -48,3 +198,9 @@ func (r *limitCloser) Close() error {
 	}
 	return nil
 }
+
+// passThroughBody is a body which the responders must not transform, see canTransform.
+type passThroughBody struct {
+	io.Reader
+	io.Closer
+}
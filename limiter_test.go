@@ -0,0 +1,105 @@
+package smallprox
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLimitBytes(t *testing.T) {
+	er := &LimitBytesResponder{}
+	er.SetLimit(10)
+	er.SetTypeLimit("image/*", 5)
+	er.SetTypeLimit("image/svg+xml", 0)
+	er.SetTypeLimit("application/octet-stream", 20)
+
+	for _, x := range []struct {
+		contentType string
+		limit       int64
+	}{
+		{"text/html; charset=utf-8", 10},
+		{"image/png", 5},
+		{"image/SVG+xml", 0},
+		{"application/octet-stream", 20},
+		{"", 0},
+	} {
+		if limit := er.LimitFor(x.contentType); limit != x.limit {
+			t.Errorf("%q: expected limit %d, got %d", x.contentType, x.limit, limit)
+		}
+	}
+
+	const content = "0123456789abcdef"
+	respond := func(policy LimitPolicy, contentLength int64) (*http.Response, string) {
+		er.SetPolicy(policy)
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: contentLength,
+			Body:          ioutil.NopCloser(strings.NewReader(content[:16])),
+		}
+		resp = er.Response(req, resp)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := respond(LimitTruncate, 16)
+	if body != content[:10] || resp.ContentLength != 10 || resp.Header.Get("Warning") == "" {
+		t.Errorf("truncate: unexpected %q %d %v", body, resp.ContentLength, resp.Header)
+	}
+	resp, body = respond(LimitTruncate, -1)
+	if body != content[:10] || resp.ContentLength != 10 || !isTruncated(resp.Header) {
+		t.Errorf("truncate: unexpected %q %d %v", body, resp.ContentLength, resp.Header)
+	}
+
+	// A range isn't truncated, its Content-Range is of the whole.
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp = er.Response(req, &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-15/100"}},
+		ContentLength: 16,
+		Body:          ioutil.NopCloser(strings.NewReader(content)),
+	})
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != content || resp.ContentLength != 16 {
+		t.Errorf("206: unexpected %q %d", body, resp.ContentLength)
+	}
+
+	// Truncated content isn't cached.
+	proxy := NewProxy(Options{CacheSize: 1 << 20})
+	rd := &reqData{}
+	proxy.cacheRequest(req, rd)
+	header := http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"max-age=60"}}
+	resp = er.Response(req, &http.Response{StatusCode: 200, Header: header, ContentLength: -1,
+		Body: ioutil.NopCloser(strings.NewReader(content))})
+	proxy.cacheResponse(req, resp, header, rd)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp := proxy.cacheRequest(req, &reqData{}); resp != nil {
+		t.Error("Expected truncated content not cached")
+	}
+
+	for _, contentLength := range []int64{16, -1} {
+		resp, _ = respond(LimitError, contentLength)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("error: expected 502, got %d", resp.StatusCode)
+		}
+		resp, body = respond(LimitPassThrough, contentLength)
+		if body != content || canTransform(&http.Request{}, resp) {
+			t.Errorf("passthrough: unexpected %q", body)
+		}
+	}
+
+	er.SetLimit(100)
+	resp, body = respond(LimitError, -1)
+	if resp.StatusCode != 200 || body != content {
+		t.Errorf("Expected content under the limit, got %d %q", resp.StatusCode, body)
+	}
+
+	if _, err := ParseLimitPolicy("passThrough"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseLimitPolicy("drop"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
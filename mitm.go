@@ -0,0 +1,126 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// newTLSConfigFunc returns the goproxy TLSConfig func for HTTPS MITM.
+// The certificate is chosen at handshake time so the client's SNI can be used.
+// genKey generates the leaf keys.
+func (proxy *Proxy) newTLSConfigFunc(ca tls.Certificate, genKey func() (crypto.Signer, error), validFor time.Duration) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		hostname := host
+		{
+			ix := strings.IndexRune(hostname, ':')
+			if ix != -1 {
+				hostname = hostname[:ix]
+			}
+		}
+		getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hostname
+			if hello.ServerName != "" {
+				name = hello.ServerName
+			}
+			getCert := func() (*tls.Certificate, error) {
+				//log.Printf("getCert for %s", name)
+				key, err := genKey()
+				if err != nil {
+					return nil, err
+				}
+				spec := proxy.mirrorUpstreamCert(host, name)
+				spec.ValidFor = validFor
+				return signHost(ca, spec, key)
+			}
+			if proxy.server.CertStore != nil {
+				return proxy.server.CertStore.Fetch(name, getCert)
+			}
+			return getCert()
+		}
+		return &tls.Config{GetCertificate: getCertificate}, nil
+	}
+}
+
+// mirrorUpstreamCert gets the names for a MITM certificate for serverName from the upstream certificate at addr.
+// The upstream names and subject are only used if the upstream certificate verifies,
+// otherwise only serverName is used.
+func (proxy *Proxy) mirrorUpstreamCert(addr, serverName string) leafSpec {
+	spec := leafSpec{Hosts: []string{serverName}}
+	if proxy.isOnboardHost(serverName) || proxy.isOffline() {
+		return spec // Served by the proxy.
+	}
+	if rule := proxy.getUpstreamTLSRule(serverName); rule != nil && rule.SkipVerify {
+		return spec
+	}
+	certs, err := proxy.fetchUpstreamCerts(addr, serverName)
+	if err != nil {
+		if proxy.server.Verbose {
+			log.Printf("Unable to get upstream certificate for %s: %s", serverName, err)
+		}
+		return spec
+	}
+	err = proxy.verifyUpstreamCerts(serverName, certs)
+	if err != nil {
+		if proxy.server.Verbose {
+			log.Printf("Not mirroring upstream certificate for %s: %s", serverName, err)
+		}
+		return spec
+	}
+	leaf := certs[0]
+	for _, name := range leaf.DNSNames {
+		if !HasAnyFold(spec.Hosts, name) {
+			spec.Hosts = append(spec.Hosts, name)
+		}
+	}
+	for _, ip := range leaf.IPAddresses {
+		if !HasAnyFold(spec.Hosts, ip.String()) {
+			spec.Hosts = append(spec.Hosts, ip.String())
+		}
+	}
+	spec.Subject = pkix.Name{
+		CommonName:         serverName,
+		Organization:       leaf.Subject.Organization,
+		OrganizationalUnit: leaf.Subject.OrganizationalUnit,
+		Country:            leaf.Subject.Country,
+		Province:           leaf.Subject.Province,
+		Locality:           leaf.Subject.Locality,
+	}
+	return spec
+}
+
+// fetchUpstreamCerts connects to addr and returns the certificates it presents.
+func (proxy *Proxy) fetchUpstreamCerts(addr, serverName string) ([]*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(proxy.ctx, 10*time.Second)
+	defer cancel()
+	conn, err := proxy.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tconn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // Only getting the certificates.
+	})
+	err = tconn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return tconn.ConnectionState().PeerCertificates, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptElem is an element of an Accept or Accept-Encoding header.
+type acceptElem struct {
+	value string // Lowercase, without parameters.
+	q     float64
+}
+
+// parseAccept parses the elements of Accept style header values.
+func parseAccept(headers []string) []acceptElem {
+	var elems []acceptElem
+	for _, header := range headers {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			value := strings.ToLower(strings.TrimSpace(params[0]))
+			if value == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+					x, err := strconv.ParseFloat(param[2:], 64)
+					if err == nil && x >= 0 && x <= 1 {
+						q = x
+					}
+				}
+			}
+			elems = append(elems, acceptElem{value: value, q: q})
+		}
+	}
+	return elems
+}
+
+// NegotiateContentEncoding chooses a content coding from offers per RFC 9110 section 12.5.3,
+// acceptEncoding are the Accept-Encoding header values.
+// The highest q-value wins, ties go to the earliest in offers (the server preference).
+// Returns "identity" if no offer is better than no encoding,
+// or empty if nothing is acceptable, not even identity.
+func NegotiateContentEncoding(acceptEncoding []string, offers []string) string {
+	if acceptEncoding == nil {
+		return "identity" // No preference, don't assume support.
+	}
+	elems := parseAccept(acceptEncoding)
+	quality := func(coding string) (float64, bool) {
+		return encodingQuality(elems, coding)
+	}
+	best := ""
+	bestq := 0.0
+	for _, offer := range offers {
+		offer = strings.ToLower(offer)
+		if q, _ := quality(offer); q > bestq {
+			best = offer
+			bestq = q
+		}
+	}
+	// Identity is acceptable unless excluded; only preferred if explicitly ranked higher.
+	identityq, explicit := quality("identity")
+	if !explicit && !hasAcceptValue(elems, "*") {
+		identityq = 1
+	}
+	if best != "" && (!explicit || bestq >= identityq) {
+		return best
+	}
+	if identityq > 0 {
+		return "identity"
+	}
+	return ""
+}
+
+// encodingQuality returns the q-value of the content coding, and whether it's explicitly listed.
+func encodingQuality(elems []acceptElem, coding string) (float64, bool) {
+	star := -1.0
+	for _, elem := range elems {
+		value := elem.value
+		if value == "x-gzip" {
+			value = "gzip"
+		}
+		if value == coding {
+			return elem.q, true
+		}
+		if value == "*" {
+			star = elem.q
+		}
+	}
+	if star >= 0 {
+		return star, false
+	}
+	return 0, false
+}
+
+// NegotiateAccept chooses a media type from offers per RFC 9110 section 12.5.1,
+// accept are the Accept header values.
+// The most specific matching media range gives the q-value of an offer,
+// the highest q-value wins, ties go to the earliest in offers (the server preference).
+// Returns empty if no offer is acceptable.
+func NegotiateAccept(accept []string, offers []string) string {
+	elems := parseAccept(accept)
+	best := ""
+	bestq := 0.0
+	for _, offer := range offers {
+		q := 1.0 // No Accept is anything.
+		if len(elems) != 0 {
+			q, _ = acceptQuality(elems, offer)
+		}
+		if q > bestq {
+			best = offer
+			bestq = q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value for mediaType from the most specific matching media range,
+// and the specificity: 0 no match, 1 */*, 2 type/*, 3 exact.
+func acceptQuality(elems []acceptElem, mediaType string) (float64, int) {
+	mediaType = strings.ToLower(mediaType)
+	if isem := strings.IndexByte(mediaType, ';'); isem != -1 {
+		mediaType = strings.TrimSpace(mediaType[:isem])
+	}
+	mainType := mediaType
+	if islash := strings.IndexByte(mediaType, '/'); islash != -1 {
+		mainType = mediaType[:islash]
+	}
+	q := 0.0
+	specificity := 0
+	for _, elem := range elems {
+		spec := 0
+		switch {
+		case elem.value == mediaType:
+			spec = 3
+		case elem.value == mainType+"/*":
+			spec = 2
+		case elem.value == "*/*":
+			spec = 1
+		}
+		if spec > specificity {
+			q = elem.q
+			specificity = spec
+		}
+	}
+	return q, specificity
+}
+
+func hasAcceptValue(elems []acceptElem, value string) bool {
+	for _, elem := range elems {
+		if elem.value == value {
+			return true
+		}
+	}
+	return false
+}
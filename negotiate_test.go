@@ -0,0 +1,55 @@
+package smallprox
+
+import (
+	"testing"
+)
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	offers := []string{"zstd", "br", "gzip"}
+	tests := []struct {
+		accept []string
+		expect string
+	}{
+		{nil, "identity"},
+		{[]string{""}, "identity"},
+		{[]string{"gzip, deflate, br, zstd"}, "zstd"},
+		{[]string{"gzip, deflate", "br"}, "br"},
+		{[]string{"br;q=0, gzip"}, "gzip"},
+		{[]string{"br;q=0.5, gzip;q=0.8"}, "gzip"},
+		{[]string{"br;q=0.8, gzip;q=0.8"}, "br"},
+		{[]string{"x-gzip"}, "gzip"},
+		{[]string{"*"}, "zstd"},
+		{[]string{"zstd;q=0, *;q=0.5"}, "br"},
+		{[]string{"deflate"}, "identity"},
+		{[]string{"gzip;q=0.5, identity"}, "identity"},
+		{[]string{"gzip, identity;q=0.5"}, "gzip"},
+		{[]string{"identity;q=0"}, ""},
+		{[]string{"*;q=0"}, ""},
+		{[]string{"GZIP ; Q=1"}, "gzip"},
+	}
+	for _, tt := range tests {
+		if got := NegotiateContentEncoding(tt.accept, offers); got != tt.expect {
+			t.Errorf("NegotiateContentEncoding(%q) = %q, expected %q", tt.accept, got, tt.expect)
+		}
+	}
+}
+
+func TestNegotiateAccept(t *testing.T) {
+	offers := []string{"image/webp", "image/jpeg"}
+	tests := []struct {
+		accept []string
+		expect string
+	}{
+		{nil, "image/webp"},
+		{[]string{"image/avif,image/webp,*/*"}, "image/webp"},
+		{[]string{"image/jpeg, image/webp;q=0.5"}, "image/jpeg"},
+		{[]string{"image/*;q=0.8, image/webp;q=0"}, "image/jpeg"},
+		{[]string{"image/png"}, ""},
+		{[]string{"*/*;q=0.1, image/jpeg;q=0.2"}, "image/jpeg"},
+	}
+	for _, tt := range tests {
+		if got := NegotiateAccept(tt.accept, offers); got != tt.expect {
+			t.Errorf("NegotiateAccept(%q) = %q, expected %q", tt.accept, got, tt.expect)
+		}
+	}
+}
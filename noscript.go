@@ -23,8 +23,13 @@ type NoscriptResponder struct {
 }
 
 func (er *NoscriptResponder) Response(req *http.Request, resp *http.Response) *http.Response {
-	if !er.Enabled() {
-		return resp
+	return ApplyStream(resp, er.StreamResponse(req, resp))
+}
+
+// StreamResponse implements StreamResponder
+func (er *NoscriptResponder) StreamResponse(req *http.Request, resp *http.Response) StreamTransform {
+	if !er.Enabled() && !savingsFor(req) {
+		return nil
 	}
 	respContentType := resp.Header.Get("Content-Type")
 	respMIMEType := respContentType
@@ -35,10 +40,12 @@ func (er *NoscriptResponder) Response(req *http.Request, resp *http.Response) *h
 		}
 	}
 	if respMIMEType == "text/html" {
-		outbuf := &Mutable{}
-		noscriptStreamer(resp.Body, outbuf)
-		resp.Body.Close()
-		resp.Body = outbuf
+		if !canTransform(req, resp) {
+			return nil
+		}
+		return func(w io.Writer, r io.Reader) error {
+			return noscriptStreamer(r, w)
+		}
 	} else {
 		simpleMIME := respMIMEType
 		if iplus := strings.IndexByte(simpleMIME, '+'); iplus != -1 {
@@ -59,7 +66,7 @@ func (er *NoscriptResponder) Response(req *http.Request, resp *http.Response) *h
 			resp.Status = fmt.Sprintf("%v %v", resp.StatusCode, "Down")
 		}
 	}
-	return resp
+	return nil
 }
 
 func noscriptStreamer(r io.Reader, w io.Writer) error {
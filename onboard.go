@@ -0,0 +1,309 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// DefaultOnboardHost is the default Options.OnboardHost
+const DefaultOnboardHost = "smallprox.local"
+
+// isOnboardHost returns true if host is the onboarding page host, port is ignored.
+func (proxy *Proxy) isOnboardHost(host string) bool {
+	proxy.mx.RLock()
+	onboardHost := proxy.opts.OnboardHost
+	proxy.mx.RUnlock()
+	if onboardHost == "" {
+		return false
+	}
+	if ilcolon := strings.LastIndexByte(host, ':'); ilcolon != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:ilcolon]
+	}
+	return strings.EqualFold(host, onboardHost)
+}
+
+// onboardNoAuth returns true if the onboarding page is allowed without proxy auth.
+func (proxy *Proxy) onboardNoAuth() bool {
+	proxy.mx.RLock()
+	x := proxy.opts.OnboardNoAuth
+	proxy.mx.RUnlock()
+	return x
+}
+
+// onboardCA returns the CA certificate clients need to trust.
+func (proxy *Proxy) onboardCA() (*x509.Certificate, bool, error) {
+	proxy.mx.RLock()
+	ca := proxy.opts.CA
+	root := proxy.opts.OnboardCA
+	proxy.mx.RUnlock()
+	isDefault := false
+	if ca.PrivateKey == nil {
+		ca = goproxy.GoproxyCa
+		isDefault = true
+	} else if root != nil {
+		return root, false, nil
+	}
+	// The last certificate is the closest to the root.
+	cert, err := x509.ParseCertificate(ca.Certificate[len(ca.Certificate)-1])
+	return cert, isDefault, err
+}
+
+// onboardResponse returns the onboarding page or CA download for the request path.
+func (proxy *Proxy) onboardResponse(req *http.Request) *http.Response {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return newResponse(req, http.StatusMethodNotAllowed, "text/plain", []byte("Method Not Allowed"))
+	}
+	cert, isDefault, err := proxy.onboardCA()
+	if err != nil {
+		return newResponse(req, http.StatusInternalServerError, "text/plain", []byte(err.Error()))
+	}
+	var resp *http.Response
+	switch req.URL.Path {
+	case "/", "":
+		resp = newHTMLResponse(req, http.StatusOK, "OK", onboardTemplate, &onboardData{
+			Subject:    cert.Subject.String(),
+			NotAfter:   cert.NotAfter.UTC().Format("2006-01-02"),
+			SHA256:     FingerprintSHA256(cert.Raw),
+			SHA1:       FingerprintSHA1(cert.Raw),
+			MITM:       proxy.getHTTPSMITM(),
+			DefaultCA:  isDefault,
+			OnboardURL: "http://" + req.Host + "/",
+		})
+	case "/ca.pem":
+		resp = newResponse(req, http.StatusOK, "application/x-pem-file", EncodeCertificatePEM(cert.Raw))
+		resp.Header.Set("Content-Disposition", `attachment; filename="smallprox-ca.pem"`)
+	case "/ca.crt", "/ca.cer", "/ca.der":
+		resp = newResponse(req, http.StatusOK, "application/x-x509-ca-cert", cert.Raw)
+	case "/ca.mobileconfig":
+		profile, err := mobileconfig(cert)
+		if err != nil {
+			return newResponse(req, http.StatusInternalServerError, "text/plain", []byte(err.Error()))
+		}
+		resp = newResponse(req, http.StatusOK, "application/x-apple-aspen-config", profile)
+		resp.Header.Set("Content-Disposition", `attachment; filename="smallprox-ca.mobileconfig"`)
+	default:
+		return newResponse(req, http.StatusNotFound, "text/plain", []byte("Not Found"))
+	}
+	if req.Method == "HEAD" {
+		resp.Body = ioutil.NopCloser(&bytes.Buffer{})
+	}
+	return resp
+}
+
+// serveOnboard serves the onboarding page to clients connecting to the proxy directly.
+// Without an onboarding host, it's the goproxy default.
+// The quota API is also served here, see serveQuotaAPI.
+func (proxy *Proxy) serveOnboard(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/quota" || strings.HasPrefix(req.URL.Path, "/quota/") {
+		proxy.serveQuotaAPI(w, req)
+		return
+	}
+	proxy.mx.RLock()
+	enabled := proxy.opts.OnboardHost != ""
+	proxy.mx.RUnlock()
+	if !enabled {
+		http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+		return
+	}
+	if proxy.getAuth() != "" && !proxy.onboardNoAuth() {
+		http.Error(w, "This is a proxy server", http.StatusForbidden)
+		return
+	}
+	resp := proxy.onboardResponse(req)
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// newResponse returns a response with the body.
+func newResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		Request:       req,
+		Header:        header,
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%v %v", status, http.StatusText(status)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+type onboardData struct {
+	Subject    string
+	NotAfter   string
+	SHA256     string
+	SHA1       string
+	MITM       bool
+	DefaultCA  bool
+	OnboardURL string
+}
+
+var onboardTemplate = template.Must(template.New("onboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>smallprox CA</title></head>
+<body>
+<h1>smallprox CA</h1>
+{{if .DefaultCA}}<p><b>Warning:</b> this proxy uses the publicly known built-in CA, anyone can impersonate sites to devices which trust it.</p>
+{{end}}{{if not .MITM}}<p>HTTPS MITM is not enabled, so installing the CA is not needed.</p>
+{{end}}<p>Install this CA certificate so the proxy can filter HTTPS sites.
+Compare the fingerprint with the one from the proxy administrator before trusting it.</p>
+<table>
+<tr><th align="left">Subject</th><td>{{.Subject}}</td></tr>
+<tr><th align="left">Expires</th><td>{{.NotAfter}}</td></tr>
+<tr><th align="left">SHA-256</th><td><code>{{.SHA256}}</code></td></tr>
+<tr><th align="left">SHA-1</th><td><code>{{.SHA1}}</code></td></tr>
+</table>
+<h2>Download</h2>
+<ul>
+<li><a href="/ca.crt">ca.crt</a> (DER) for Android, Windows and Chrome OS</li>
+<li><a href="/ca.mobileconfig">ca.mobileconfig</a> for iOS, iPadOS and macOS</li>
+<li><a href="/ca.pem">ca.pem</a> (PEM) for Linux, Firefox and other software</li>
+</ul>
+<h2>Instructions</h2>
+<dl>
+<dt>iOS / iPadOS</dt>
+<dd>Open this page in Safari, download ca.mobileconfig, then install it in Settings &gt; General &gt; VPN &amp; Device Management.
+Then enable full trust in Settings &gt; General &gt; About &gt; Certificate Trust Settings.</dd>
+<dt>Android</dt>
+<dd>Download ca.crt, then install it in Settings &gt; Security &gt; Encryption &amp; credentials &gt; Install a certificate &gt; CA certificate.
+Note that many apps only trust the system CAs.</dd>
+<dt>macOS</dt>
+<dd>Open ca.mobileconfig and install the profile in System Settings &gt; Privacy &amp; Security &gt; Profiles,
+or add ca.pem to the System keychain in Keychain Access and set it to Always Trust.</dd>
+<dt>Windows</dt>
+<dd>Open ca.crt, choose Install Certificate, Local Machine, and place it in Trusted Root Certification Authorities.</dd>
+<dt>Linux</dt>
+<dd>Copy ca.pem to <code>/usr/local/share/ca-certificates/smallprox-ca.crt</code> and run <code>update-ca-certificates</code>
+(or use <code>trust anchor ca.pem</code> on Fedora and Arch).</dd>
+<dt>Firefox</dt>
+<dd>Settings &gt; Privacy &amp; Security &gt; Certificates &gt; View Certificates &gt; Authorities &gt; Import ca.pem,
+and trust it to identify websites.</dd>
+</dl>
+<p>This page is served by the proxy at <a href="{{.OnboardURL}}">{{.OnboardURL}}</a></p>
+</body></html>
+`))
+
+// mobileconfig returns an Apple configuration profile which installs cert as a trusted root.
+func mobileconfig(cert *x509.Certificate) ([]byte, error) {
+	sum := sha256.Sum256(cert.Raw)
+	fp := hex.EncodeToString(sum[:])
+	data := struct {
+		Name        string
+		Cert        string
+		ID          string
+		UUID        string
+		PayloadUUID string
+	}{
+		Name:        cert.Subject.CommonName,
+		Cert:        base64.StdEncoding.EncodeToString(cert.Raw),
+		ID:          fp[:16],
+		UUID:        uuidFrom(fp + "\x00profile"),
+		PayloadUUID: uuidFrom(fp + "\x00root"),
+	}
+	if data.Name == "" {
+		data.Name = "smallprox CA"
+	}
+	buf := &bytes.Buffer{}
+	err := mobileconfigTemplate.Execute(buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uuidFrom returns a version 4 format UUID derived from s, so it's stable.
+func uuidFrom(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	sum[6] = (sum[6] & 0x0f) | 0x40
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	x := strings.ToUpper(hex.EncodeToString(sum[:16]))
+	return x[:8] + "-" + x[8:12] + "-" + x[12:16] + "-" + x[16:20] + "-" + x[20:]
+}
+
+var mobileconfigTemplate = texttemplate.Must(texttemplate.New("mobileconfig").Funcs(texttemplate.FuncMap{
+	"xml": func(s string) (string, error) {
+		buf := &bytes.Buffer{}
+		err := xml.EscapeText(buf, []byte(s))
+		return buf.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>smallprox-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDescription</key>
+			<string>Adds a CA root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>{{xml .Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>local.smallprox.ca.{{.ID}}.root</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.PayloadUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDescription</key>
+	<string>Trust the smallprox CA for HTTPS filtering</string>
+	<key>PayloadDisplayName</key>
+	<string>{{xml .Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>local.smallprox.ca.{{.ID}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.UUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// onboardConnectAction returns the action for a CONNECT to the onboarding host,
+// it's always handled by the proxy.
+func (proxy *Proxy) onboardConnectAction(host string, rd *reqData) *goproxy.ConnectAction {
+	if strings.HasSuffix(host, ":80") {
+		rd.info.MITM = true
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm}
+	}
+	if strings.HasSuffix(host, ":443") && proxy.getHTTPSMITM() {
+		rd.info.MITM = true
+		rd.info.TLS = true
+		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: proxy.tlsConfigFunc}
+	}
+	return &goproxy.ConnectAction{Action: goproxy.ConnectReject}
+}
@@ -0,0 +1,75 @@
+package smallprox
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOnboard(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: "ecdsa", CommonName: "Test <CA> & Co"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(Options{CA: ca, OnboardHost: DefaultOnboardHost})
+	for _, host := range []string{"smallprox.local", "SMALLPROX.LOCAL:443", "smallprox.local:80"} {
+		if !proxy.isOnboardHost(host) {
+			t.Errorf("Expected onboard host: %s", host)
+		}
+	}
+	if proxy.isOnboardHost("example.com") || proxy.isOnboardHost("smallprox.local.example.com") {
+		t.Error("Unexpected onboard host")
+	}
+
+	get := func(path string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", "http://smallprox.local"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := proxy.onboardResponse(req)
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	resp, body := get("/")
+	if resp.StatusCode != 200 || !strings.Contains(string(body), FingerprintSHA256(ca.Certificate[0])) {
+		t.Errorf("Expected the page with the fingerprint, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = get("/ca.crt")
+	if resp.StatusCode != 200 || !bytes.Equal(body, ca.Certificate[0]) {
+		t.Errorf("Expected the DER certificate, got %d", resp.StatusCode)
+	}
+	resp, body = get("/ca.mobileconfig")
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected the mobileconfig, got %d", resp.StatusCode)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false // The DOCTYPE.
+	for {
+		_, err := dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("Invalid mobileconfig XML: %s", err)
+			}
+			break
+		}
+	}
+	if !bytes.Contains(body, []byte("Test &lt;CA&gt; &amp; Co")) {
+		t.Errorf("Expected the escaped CA name in: %s", body)
+	}
+	resp, _ = get("/nope")
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+
+	_, body = get("/ca.pem")
+	if !bytes.Contains(body, []byte("BEGIN CERTIFICATE")) {
+		t.Errorf("Expected PEM, got %s", body)
+	}
+}
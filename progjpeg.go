@@ -0,0 +1,38 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+
+	"golang.org/x/exp/errors/fmt"
+)
+
+// JPEGTranPath is the jpegtran command of libjpeg, used for ImageShrinkOptions.ProgressiveJPEG.
+var JPEGTranPath = "jpegtran"
+
+// CheckProgressiveJPEG returns an error if JPEGTranPath isn't found, so ProgressiveJPEG can't work.
+func CheckProgressiveJPEG() error {
+	if _, err := exec.LookPath(JPEGTranPath); err != nil {
+		return fmt.Errorf("progressive JPEG requires jpegtran: %w", err)
+	}
+	return nil
+}
+
+// progressiveJPEG losslessly converts a baseline JPEG to progressive with jpegtran.
+func progressiveJPEG(ctx context.Context, data []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, JPEGTranPath, "-progressive", "-optimize", "-copy", "none")
+	cmd.Stdin = bytes.NewReader(data)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("jpegtran: %w", err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,70 @@
+package smallprox
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressiveJPEG(t *testing.T) {
+	er := &ImageShrinkResponder{}
+	er.SetEnabled(true)
+	opts := DefaultImageShrinkOptions
+	opts.MaxDimension = 100
+	opts.ProgressiveJPEG = true
+	er.SetOptions(opts)
+	data := testPNG(t, 300, 200)
+
+	if _, err := exec.LookPath("jpegtran"); err == nil {
+		resp := shrinkImage(er, "http://example.com/a.png", "image/*", data)
+		out, _ := ioutil.ReadAll(resp.Body)
+		if !bytes.Contains(out, []byte{0xff, 0xc2}) {
+			t.Error("Expected a progressive JPEG")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Error(err)
+		}
+	} else {
+		t.Log("jpegtran not found, using stubs")
+	}
+
+	dir, err := ioutil.TempDir("", "smallprox-jpegtran")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { JPEGTranPath = path }(JPEGTranPath)
+	stub := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	JPEGTranPath = stub("ok", `cat >/dev/null; printf converted`)
+	if err := CheckProgressiveJPEG(); err != nil {
+		t.Fatal(err)
+	}
+	resp := shrinkImage(er, "http://example.com/a.png", "image/*", data)
+	if out, _ := ioutil.ReadAll(resp.Body); string(out) != "converted" {
+		t.Errorf("Expected the jpegtran output, got %d bytes", len(out))
+	}
+
+	// The baseline JPEG is kept if jpegtran fails.
+	JPEGTranPath = stub("fail", `exit 1`)
+	resp = shrinkImage(er, "http://example.com/a.png", "image/*", data)
+	out, _ := ioutil.ReadAll(resp.Body)
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected the baseline JPEG, got %v", err)
+	}
+
+	JPEGTranPath = filepath.Join(dir, "missing")
+	if err := CheckProgressiveJPEG(); err == nil {
+		t.Error("Expected an error without jpegtran")
+	}
+}
@@ -7,14 +7,16 @@
 package smallprox
 
 import (
-	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/tls"
-	"io/ioutil"
+	"crypto/x509"
 	"log"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -29,13 +31,13 @@ import (
 
 // Requester allows handling a request.
 // Return a non-nil response to finish the request early.
-// Use req.Context()
+// Use req.Context(), see RequestInfoFromContext
 type Requester interface {
 	Request(req *http.Request) (*http.Request, *http.Response)
 }
 
 // Responder allows handling a response.
-// Use req.Context()
+// Use req.Context(), see RequestInfoFromContext
 type Responder interface {
 	Response(req *http.Request, resp *http.Response) *http.Response
 }
@@ -44,12 +46,32 @@ type Responder interface {
 type Options struct {
 	Verbose            bool
 	Addresses          []string
-	InsecureSkipVerify bool
-	BlockHosts         []string // list of hosts
+	InsecureSkipVerify bool              // Don't verify upstream TLS certificates, unless an UpstreamTLS rule matches.
+	UpstreamTLS        []UpstreamTLSRule // The first matching rule is used.
+	BlockHosts         []string          // list of hosts
 	ConnectMITM        bool
 	HTTPSMITM          bool
 	CA                 tls.Certificate // Do not modify the pointers/arrays!
+	AllowDefaultCA     bool            // Allow HTTPSMITM with the publicly known goproxy CA if no CA.
+	CertCacheSize      int             // Max leaf certificates in memory, 0 for DefaultCertCacheSize
+	CertCacheDir       string          // Directory to persist leaf certificates, encrypted; empty to disable.
+	KeyPoolSize        int             // Number of leaf keys to pregenerate in the background, 0 to disable.
+	LeafCertValidity   time.Duration   // How long MITM certificates are valid, 0 for DefaultLeafValidity
+	LeafKeyType        string          // MITM certificate key type: rsa, ecdsa, ed25519; empty for the CA key type.
 	Auth               string
+	AdminSecret        string            // Secret for admin requests in the AdminSecretHeader, such as the quota API; empty to disable them.
+	OnboardHost        string            // Host name of the CA onboarding page, such as DefaultOnboardHost; empty to disable.
+	OnboardNoAuth      bool              // Allow the onboarding page without Auth.
+	OnboardCA          *x509.Certificate // The CA clients trust, offered by the onboarding page; nil for the last certificate of CA, see LoadCARoot
+	CacheSize          int64             // Max bytes of responses cached in memory, 0 to disable the cache.
+	CacheDir           string            // Directory for the on-disk cache tier, empty for memory only.
+	CacheDirSize       int64             // Max bytes cached on disk, 0 for DefaultCacheDirSize
+	CacheMaxObject     int64             // Max bytes of a cached response, 0 for DefaultCacheMaxObject
+	CacheStaleIfError  time.Duration     // How long past freshness to serve a cached response if upstream fails, 0 for DefaultCacheStaleIfError, negative to disable. Within HTTP MITM, only for 5xx errors: goproxy answers connection errors itself.
+	Offline            bool              // Only serve from the cache, never contact upstream.
+	RateLimits         RateLimits        // Bandwidth shaping.
+	Quotas             Quotas            // Data quotas.
+	ResponderTimeout   time.Duration     // Time budget of each responder, 0 for DefaultResponderTimeout, negative for no limit; see TimeBudgeter.
 }
 
 // Copy performs a readonly copy.
@@ -57,16 +79,27 @@ func (opts *Options) Copy() Options {
 	newopts := *opts
 	newopts.Addresses = append([]string(nil), opts.Addresses...)
 	newopts.BlockHosts = append([]string(nil), opts.BlockHosts...)
+	newopts.UpstreamTLS = append([]UpstreamTLSRule(nil), opts.UpstreamTLS...)
+	newopts.RateLimits = opts.RateLimits.Copy()
+	newopts.Quotas = opts.Quotas.Copy()
 	return newopts
 }
 
 // Proxy is the proxy.
 type Proxy struct {
+	connSeq       int64 // atomic, first for alignment
+	reqSeq        int64 // atomic
 	mx            sync.RWMutex
 	opts          Options
 	dialer        net.Dialer
 	server        *goproxy.ProxyHttpServer
+	certStore     *myCertStore
+	keyPool       *keyPool // nil if disabled
+	cache         *cacheStore
+	shaper        shaper
+	quotas        quotaStore
 	httpservers   []*http.Server
+	listenAddrs   []*net.TCPAddr
 	tlsConfigFunc func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
 	ctx           context.Context
 	cancel        func()
@@ -91,16 +124,20 @@ func NewProxy(opts Options) *Proxy {
 		ctx:    context.Background(),
 	}
 	proxy.server.Tr = &http.Transport{
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: proxy.opts.InsecureSkipVerify},
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true, VerifyConnection: proxy.verifyConnection},
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           proxy.dialContext,
+		DialTLSContext:        proxy.dialTLSContext,
 		Dial:                  proxy.dial, // Directly used by default ConnectDial.
 		MaxConnsPerHost:       50,
 		IdleConnTimeout:       5 * time.Minute,
 		ResponseHeaderTimeout: 30 * time.Second,
 	}
 	proxy.server.Verbose = proxy.opts.Verbose
-	proxy.server.CertStore = newCertStore()
+	proxy.certStore = newCertStore()
+	proxy.cache = newCacheStore()
+	proxy.server.CertStore = proxy.certStore
+	proxy.server.NonproxyHandler = http.HandlerFunc(proxy.serveOnboard)
 	proxy.optsChanged() // Lock not needed yet.
 	proxy.addHandlers()
 	return proxy
@@ -166,7 +203,12 @@ func (proxy *Proxy) dialContext(ctx context.Context, network string, addr string
 	if proxy.IsHostBlocked(host) {
 		return nil, &net.DNSError{Err: "Blocked", Name: host}
 	}
-	return proxy.dialer.DialContext(ctx, network, addr)
+	conn, err := proxy.dialer.DialContext(ctx, network, addr)
+	if err == nil && proxy.isOwnAddr(conn.RemoteAddr()) {
+		conn.Close()
+		return nil, fmt.Errorf("refusing to proxy to the proxy itself at %s", addr)
+	}
+	return conn, err
 }
 
 func (proxy *Proxy) dial(network string, addr string) (net.Conn, error) {
@@ -179,30 +221,36 @@ func (proxy *Proxy) optsChanged() {
 	if ca.PrivateKey == nil {
 		ca = goproxy.GoproxyCa
 	}
-	proxy.tlsConfigFunc = func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
-		hostname := host
-		{
-			ix := strings.IndexRune(hostname, ':')
-			if ix != -1 {
-				hostname = hostname[:ix]
-			}
-		}
-		getCert := func() (*tls.Certificate, error) {
-			//log.Printf("getCert for %s", hostname)
-			return signHost(ca, []string{hostname})
-		}
-		var cert *tls.Certificate
-		var err error
-		if proxy.server.CertStore != nil {
-			cert, err = proxy.server.CertStore.Fetch(hostname, getCert)
-		} else {
-			cert, err = getCert()
-		}
-		if err != nil {
-			return nil, err
+	err := proxy.certStore.configure(ca, proxy.opts.CertCacheSize, proxy.opts.CertCacheDir)
+	if err != nil {
+		log.Printf("Certificate cache error: %s", err)
+	}
+	err = proxy.cache.configure(proxy.opts.CacheSize, proxy.opts.CacheDir, proxy.opts.CacheDirSize, proxy.opts.CacheMaxObject)
+	if err != nil {
+		log.Printf("Cache error: %s", err)
+	}
+	proxy.shaper.configure(proxy.opts.RateLimits)
+	err = proxy.quotas.configure(proxy.opts.Quotas)
+	if err != nil {
+		log.Printf("Quota error: %s", err)
+	}
+	if proxy.keyPool != nil {
+		proxy.keyPool.Stop()
+		proxy.keyPool = nil
+	}
+	leafKeyType := proxy.opts.LeafKeyType
+	genKey := func() (crypto.Signer, error) {
+		return newLeafKey(leafKeyType, ca.PrivateKey, rand.Reader)
+	}
+	if proxy.opts.KeyPoolSize > 0 {
+		pool := newKeyPool(proxy.opts.KeyPoolSize, genKey)
+		proxy.keyPool = pool
+		if proxy.opts.HTTPSMITM && atomic.LoadInt32(&proxy.state) == stateRun {
+			pool.Start()
 		}
-		return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+		genKey = pool.Get
 	}
+	proxy.tlsConfigFunc = proxy.newTLSConfigFunc(ca, genKey, proxy.opts.LeafCertValidity)
 }
 
 /*
@@ -224,11 +272,30 @@ func (ctx *ctx2) Value(key interface{}) interface{} {
 	return val
 }
 
+func (proxy *Proxy) connContext(ctx context.Context, c net.Conn) context.Context {
+	if cc, ok := c.(*clientConn); ok {
+		ctx = context.WithValue(ctx, clientConnKey{}, cc)
+	}
+	return context.WithValue(ctx, connIDKey{}, atomic.AddInt64(&proxy.connSeq, 1))
+}
+
 func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if proxy.ctx != nil {
 		// TODO: revisit this...
 		// Consider github.com/teivah/onecontext
-		r = r.WithContext(&ctx2{proxy.ctx, r.Context()})
+		// Canceled if the client goes away or the proxy stops.
+		ctx, cancel := context.WithCancel(&ctx2{proxy.ctx, r.Context()})
+		defer cancel()
+		finished := make(chan struct{})
+		defer close(finished)
+		go func(clientDone <-chan struct{}) {
+			select {
+			case <-clientDone:
+				cancel()
+			case <-finished:
+			}
+		}(r.Context().Done())
+		r = r.WithContext(ctx)
 	}
 	proxy.server.ServeHTTP(w, r)
 }
@@ -243,18 +310,41 @@ func (proxy *Proxy) ListenAndServeContext(ctx context.Context) error {
 		if len(proxy.opts.Addresses) == 0 {
 			return errors.New("No addresses")
 		}
+		if proxy.opts.HTTPSMITM && proxy.opts.CA.PrivateKey == nil && !proxy.opts.AllowDefaultCA {
+			return errors.New("HTTPS MITM requires a CA; the default CA key is publicly known")
+		}
 		if !atomic.CompareAndSwapInt32(&proxy.state, stateNew, stateRun) {
 			return errors.New("Already running")
 		}
 		for _, addr := range proxy.opts.Addresses {
-			proxy.httpservers = append(proxy.httpservers, &http.Server{Addr: addr, Handler: proxy})
+			proxy.httpservers = append(proxy.httpservers, &http.Server{
+				Addr:        addr,
+				Handler:     proxy,
+				ConnContext: proxy.connContext,
+			})
 		}
 		proxy.cancel = cancel
 		proxy.ctx = ctx
+		if proxy.keyPool != nil && proxy.opts.HTTPSMITM {
+			proxy.keyPool.Start()
+		}
 		for _, httpserver := range proxy.httpservers {
 			httpserver := httpserver
 			eg.Go(func() error {
-				return httpserver.ListenAndServe()
+				addr := httpserver.Addr
+				if addr == "" {
+					addr = ":http"
+				}
+				ln, err := net.Listen("tcp", addr)
+				if err != nil {
+					return err
+				}
+				if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+					proxy.mx.Lock()
+					proxy.listenAddrs = append(proxy.listenAddrs, tcpAddr)
+					proxy.mx.Unlock()
+				}
+				return httpserver.Serve(clientListener{ln, ctx})
 			})
 		}
 		return nil
@@ -301,6 +391,9 @@ func (proxy *Proxy) stop(shutdownCtx context.Context) error {
 	func() {
 		proxy.mx.Lock()
 		defer proxy.mx.Unlock()
+		if proxy.keyPool != nil {
+			proxy.keyPool.Stop()
+		}
 		for _, httpserver := range proxy.httpservers {
 			httpserver := httpserver
 			eg.Go(func() error {
@@ -312,6 +405,9 @@ func (proxy *Proxy) stop(shutdownCtx context.Context) error {
 		}
 	}()
 	err := eg.Wait()
+	if qerr := proxy.quotas.save(); qerr != nil {
+		log.Printf("Error saving quota usage: %s", qerr)
+	}
 	if err != nil {
 		proxy.mx.Lock()
 		proxy.err = err
@@ -349,20 +445,52 @@ func (proxy *Proxy) getHTTPSMITM() bool {
 	return x
 }
 
-func (proxy *Proxy) authCheck(u, p string) bool {
+func (proxy *Proxy) isOffline() bool {
+	proxy.mx.RLock()
+	x := proxy.opts.Offline
+	proxy.mx.RUnlock()
+	return x
+}
+
+func (proxy *Proxy) getCacheStaleIfError() time.Duration {
+	proxy.mx.RLock()
+	x := proxy.opts.CacheStaleIfError
+	proxy.mx.RUnlock()
+	if x == 0 {
+		x = DefaultCacheStaleIfError
+	}
+	return x
+}
+
+// quotaBlocked returns true if the client used up its quota with QuotaBlock.
+func (proxy *Proxy) quotaBlocked(rd *reqData) bool {
+	action, u := proxy.quotas.exceeded(rd.clientKey(), time.Now())
+	return u != nil && action == QuotaBlock
+}
+
+// authCheck returns the configured username if u and p are accepted, so the user is the same however u is spelled.
+func (proxy *Proxy) authCheck(u, p string) (string, bool) {
 	proxyauth := proxy.getAuth()
 	icolon := strings.IndexByte(proxyauth, ':')
 	if icolon == -1 {
-		return false
+		return "", false
 	}
 	username := proxyauth[:icolon]
 	password := proxyauth[icolon+1:]
-	return strings.EqualFold(u, username) && p == password
+	return username, strings.EqualFold(u, username) && p == password
 }
 
+// reqData is shared by all the requests within a CONNECT.
 type reqData struct {
-	acceptEncoding string // original
+	acceptEncoding string      // original
+	conn           *clientConn // The client connection, if known.
 	withinCONNECT  bool
+	info           RequestInfo
+	requestID      int64       // For the current request.
+	cache          *cacheState // For the current request, nil if not cacheable.
+	quotaWarning   *QuotaUsage // For the current request, set to warn with QuotaWarn.
+	admin          bool        // For the current request, true if it has the admin secret.
+	tunnel         bool        // Upstream bytes don't go through roundTrip, see shapeTunnel.
 }
 
 func getReqData(ctx *goproxy.ProxyCtx) *reqData {
@@ -370,30 +498,58 @@ func getReqData(ctx *goproxy.ProxyCtx) *reqData {
 		return ctx.UserData.(*reqData)
 	}
 	rd := &reqData{}
+	rd.info.ConnID, _ = connIDFromContext(ctx.Req.Context())
+	rd.info.ClientAddr = ctx.Req.RemoteAddr
+	rd.conn = clientConnFromContext(ctx.Req.Context())
 	ctx.UserData = rd
 	return rd
 }
 
+// requestContext returns parent with a copy of the RequestInfo for this request.
+func (rd *reqData) requestContext(parent context.Context) context.Context {
+	info := rd.info
+	info.RequestID = rd.requestID
+	return withRequestInfo(parent, &info)
+}
+
 func (proxy *Proxy) addHandlers() {
 	// Auth:
 	realm := "Proxy"
-	authBasic := auth.Basic(realm, proxy.authCheck)
+	// authCheckFor records the authenticated user in rd.
+	authCheckFor := func(rd *reqData) func(u, p string) bool {
+		return func(u, p string) bool {
+			if username, ok := proxy.authCheck(u, p); ok {
+				rd.info.User = username
+				return true
+			}
+			return false
+		}
+	}
 	proxy.server.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		getReqData(ctx).cache = nil // New request.
 		if proxy.getAuth() != "" {
 			rd := getReqData(ctx)
-			if !rd.withinCONNECT {
+			if !rd.withinCONNECT && !(proxy.isOnboardHost(req.URL.Host) && proxy.onboardNoAuth()) {
 				// ONLY do this if we haven't already done this for a CONNECT!
-				return authBasic.Handle(req, ctx)
+				return auth.Basic(realm, authCheckFor(rd)).Handle(req, ctx)
 			}
 		}
 		return req, nil
 	})
-	authBasicConnect := auth.BasicConnect(realm, proxy.authCheck)
+	// Onboarding page:
+	proxy.server.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if proxy.isOnboardHost(req.URL.Host) {
+			return req, proxy.onboardResponse(req)
+		}
+		return req, nil
+	})
 	proxy.server.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 		rd := getReqData(ctx)
 		rd.withinCONNECT = true
-		if proxy.getAuth() != "" {
-			todo, newhost := authBasicConnect.HandleConnect(host, ctx)
+		rd.info.ConnectHost = host
+		onboard := proxy.isOnboardHost(host)
+		if proxy.getAuth() != "" && !(onboard && proxy.onboardNoAuth()) {
+			todo, newhost := auth.BasicConnect(realm, authCheckFor(rd)).HandleConnect(host, ctx)
 			host = newhost
 			if todo != nil && todo.Action == goproxy.ConnectReject {
 				return &goproxy.ConnectAction{
@@ -402,6 +558,12 @@ func (proxy *Proxy) addHandlers() {
 			}
 			// Granted...
 		}
+		if onboard {
+			// Never tunnel to a real host by this name.
+			return proxy.onboardConnectAction(host, rd), host
+		}
+		proxy.shape(rd, host) // Also for tunnels.
+		proxy.account(rd)
 		return nil, host
 	})
 
@@ -410,11 +572,25 @@ func (proxy *Proxy) addHandlers() {
 		rd := getReqData(ctx)
 		rd.withinCONNECT = true
 		//log.Printf("handle connect func for :80 %+v", ctx)
+		if proxy.isOffline() {
+			// HTTP MITM connects upstream right away, not through the cache.
+			return &goproxy.ConnectAction{
+				Action: goproxy.ConnectReject,
+			}, host
+		}
 		if proxy.getConnectMITM() {
+			rd.info.MITM = true
+			proxy.shapeTunnel(rd, host) // HTTP MITM doesn't go through roundTrip.
 			return &goproxy.ConnectAction{
 				Action: goproxy.ConnectHTTPMitm,
 			}, host
 		}
+		if proxy.quotaBlocked(rd) {
+			return &goproxy.ConnectAction{
+				Action: goproxy.ConnectReject,
+			}, host
+		}
+		proxy.shapeTunnel(rd, host)
 		return &goproxy.ConnectAction{
 			Action: goproxy.ConnectAccept,
 		}, host
@@ -425,11 +601,19 @@ func (proxy *Proxy) addHandlers() {
 		rd.withinCONNECT = true
 		//log.Printf("handle connect func for :443 %+v", ctx)
 		if proxy.getHTTPSMITM() {
+			rd.info.MITM = true
+			rd.info.TLS = true
 			return &goproxy.ConnectAction{
 				Action:    goproxy.ConnectMitm,
 				TLSConfig: proxy.tlsConfigFunc,
 			}, host
 		}
+		if proxy.isOffline() || proxy.quotaBlocked(rd) {
+			return &goproxy.ConnectAction{
+				Action: goproxy.ConnectReject,
+			}, host
+		}
+		proxy.shapeTunnel(rd, host)
 		return &goproxy.ConnectAction{
 			Action: goproxy.ConnectAccept,
 		}, host
@@ -445,8 +629,32 @@ func (proxy *Proxy) addHandlers() {
 	// Handle requests:
 	proxy.server.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		//log.Printf("got regular OnRequest().DoFunc %+v", req)
-		req = req.WithContext(proxy.ctx)
 		rd := getReqData(ctx)
+		// Not ctx.Session, which is the same for the requests of an HTTP MITM CONNECT.
+		rd.requestID = atomic.AddInt64(&proxy.reqSeq, 1)
+		parent := proxy.ctx
+		if !rd.info.MITM {
+			parent = ctx.Req.Context() // The upstream request is canceled if the client goes away.
+		}
+		rd.info.Savings = false
+		rd.quotaWarning = nil
+		action, quotaUsage := proxy.quotas.exceeded(rd.clientKey(), time.Now())
+		if quotaUsage != nil {
+			switch action {
+			case QuotaBlock:
+				return req, quotaResponse(req, quotaUsage)
+			case QuotaSave:
+				rd.info.Savings = true
+			case QuotaWarn:
+				rd.quotaWarning = quotaUsage
+			}
+		}
+		req = req.WithContext(rd.requestContext(parent))
+		ctx.RoundTripper = goproxy.RoundTripperFunc(proxy.roundTrip)
+		proxy.shape(rd, req.URL.Host)
+		proxy.account(rd)
+		rd.admin = proxy.isAdmin(req)
+		req.Header.Del(AdminSecretHeader)                     // Never sent upstream.
 		rd.acceptEncoding = req.Header.Get("Accept-Encoding") // Preserve original.
 		for _, er := range proxy.getRequesters() {
 			newReq, resp := er.Request(req)
@@ -458,6 +666,12 @@ func (proxy *Proxy) addHandlers() {
 			}
 			req = newReq
 		}
+		if quotaUsage != nil {
+			return req, nil // Not cached, the response is for this client.
+		}
+		if resp := proxy.cacheRequest(req, rd); resp != nil {
+			return req, resp
+		}
 		return req, nil
 	})
 
@@ -469,41 +683,54 @@ func (proxy *Proxy) addHandlers() {
 			// Apparently this can happen if there was an error during the server request.
 			log.Printf("Error during round trip: %+v", ctx.Error)
 			//return nil
-			var status int
-			var statusText string
-			xerr := ctx.Error
-			if netoperr, ok := xerr.(*net.OpError); ok {
-				xerr = netoperr.Err // Unwrap
-			}
-			if _, ok := xerr.(*net.DNSError); ok {
-				status = 521
-				statusText = "Down"
-			} else {
-				status = http.StatusBadGateway
-				statusText = http.StatusText(status)
-			}
-			return &http.Response{
-				Request:    ctx.Req,
-				Header:     make(http.Header),
-				StatusCode: status,
-				Status:     fmt.Sprintf("%v %v", status, statusText),
-				Body:       ioutil.NopCloser(bytes.NewBufferString(statusText)),
+			return errorResponse(ctx.Req, ctx.Error)
+		}
+		clientReq := ctx.Req
+		if rd.tunnel && resp.Request != nil {
+			clientReq = resp.Request // HTTP MITM keeps the CONNECT in ctx.Req.
+		}
+		if rd.cache != nil && rd.cache.fromCache {
+			return resp // Already through the responders.
+		}
+		if cached := proxy.cacheRevalidated(clientReq, resp, rd); cached != nil {
+			return cached
+		}
+		if rd.tunnel && resp.StatusCode >= 500 && resp.StatusCode <= 504 {
+			// HTTP MITM doesn't go through roundTrip.
+			if cached := proxy.cacheStaleIfError(clientReq, rd); cached != nil {
+				resp.Body.Close()
+				return cached
 			}
 		}
+		upstreamHeader := cloneHeader(resp.Header)
 		// The timeout is only for the responders, not the returned stream.
-		goctx, cancel := context.WithTimeout(proxy.ctx, time.Minute*1) // TODO: revisit... too short?
-		req := ctx.Req.WithContext(goctx)
-		defer cancel()
+		// The responders stop if the client goes away.
+		cctx, stop := proxy.clientContext(ctx, rd)
+		defer stop()
+		req := clientReq.WithContext(rd.requestContext(cctx))
 		if rd.acceptEncoding != "" {
 			// Put back the accept encoding so I know what the client supports.
-			ctx.Req.Header.Set("Accept-Encoding", rd.acceptEncoding)
+			clientReq.Header.Set("Accept-Encoding", rd.acceptEncoding)
+		}
+		if err := decodeResponse(req, resp); err != nil {
+			// Responders only change content without a Content-Encoding.
+			if proxy.server.Verbose {
+				log.Printf("Not decoding response from %s: %s", req.URL.Host, err)
+			}
+		}
+		if rd.quotaWarning != nil && canTransform(req, resp) &&
+			strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			resp = ApplyStream(resp, bannerTransform(quotaBanner(rd.quotaWarning)))
 		}
 		for _, er := range proxy.getResponders() {
-			resp = er.Response(req, resp)
+			resp = proxy.respond(cctx, er, req, resp, rd)
 		}
 		if m, ok := resp.Body.(*Mutable); ok {
 			resp.ContentLength = int64(m.Len())
+			// goproxy sends the header as is.
+			resp.Header.Set("Content-Length", strconv.Itoa(m.Len()))
 		}
+		proxy.cacheResponse(req, resp, upstreamHeader, rd)
 		//log.Printf("Final response: %+v", resp)
 		return resp
 	})
@@ -0,0 +1,193 @@
+package smallprox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestProxy runs a proxy on a local port, call proxy.Close when done.
+func startTestProxy(t *testing.T, opts Options) (*Proxy, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	opts.Addresses = []string{addr}
+	proxy := NewProxy(opts)
+	go proxy.ListenAndServe()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return proxy, addr
+		}
+		if time.Since(start) > 5*time.Second {
+			proxy.Close()
+			t.Fatal(err)
+		}
+	}
+}
+
+// proxyClient returns an HTTP client using the proxy at addr.
+func proxyClient(addr string, user *url.Userinfo) *http.Client {
+	proxyURL := &url.URL{Scheme: "http", Host: addr, User: user}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+// connectProxy sends a CONNECT for host to the proxy at addr, returns the connection and the status code.
+func connectProxy(t *testing.T, addr, host string, header string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", host, host, header)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return conn, r, 0 // Closed without a response.
+	}
+	return conn, r, resp.StatusCode
+}
+
+// infoResponder records the RequestInfo of the responses.
+type infoResponder struct {
+	mx    sync.Mutex
+	infos []RequestInfo
+}
+
+func (er *infoResponder) Response(req *http.Request, resp *http.Response) *http.Response {
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		er.mx.Lock()
+		er.infos = append(er.infos, *info)
+		er.mx.Unlock()
+	}
+	return resp
+}
+
+func (er *infoResponder) last() RequestInfo {
+	er.mx.Lock()
+	defer er.mx.Unlock()
+	if len(er.infos) == 0 {
+		return RequestInfo{}
+	}
+	return er.infos[len(er.infos)-1]
+}
+
+func TestRequestInfo(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	proxy, addr := startTestProxy(t, Options{Auth: "user:pass", ConnectMITM: true})
+	defer proxy.Close()
+	er := &infoResponder{}
+	proxy.AddResponder(er)
+
+	resp, err := proxyClient(addr, url.UserPassword("user", "pass")).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	info := er.last()
+	if info.ConnID == 0 || info.RequestID == 0 || info.User != "user" || info.MITM || info.WithinCONNECT() {
+		t.Errorf("Unexpected proxied request info: %+v", info)
+	}
+	if host, _, _ := net.SplitHostPort(info.ClientAddr); host != "127.0.0.1" {
+		t.Errorf("Expected the client address, got %q", info.ClientAddr)
+	}
+
+	// HTTP MITM of a CONNECT, all to the upstream server.
+	proxy.server.Tr.Dial = func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	}
+	conn, r, status := connectProxy(t, addr, "upstream.test:80", "Proxy-Authorization: Basic dXNlcjpwYXNz\r\n")
+	defer conn.Close()
+	if status != 200 {
+		t.Fatalf("Expected CONNECT 200, got %d", status)
+	}
+	var connectInfos []RequestInfo
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		connectInfos = append(connectInfos, er.last())
+	}
+	for _, cinfo := range connectInfos {
+		if cinfo.ConnectHost != "upstream.test:80" || !cinfo.MITM || cinfo.User != "user" ||
+			cinfo.ConnID == 0 || cinfo.ConnID == info.ConnID {
+			t.Errorf("Unexpected CONNECT request info: %+v", cinfo)
+		}
+	}
+	if connectInfos[0].ConnID != connectInfos[1].ConnID {
+		t.Error("Expected the requests of a CONNECT to share the ConnID")
+	}
+	if connectInfos[0].RequestID == connectInfos[1].RequestID {
+		t.Error("Expected a RequestID per request")
+	}
+}
+
+func TestOfflineConnect(t *testing.T) {
+	proxy, addr := startTestProxy(t, Options{ConnectMITM: true, Offline: true})
+	defer proxy.Close()
+	var dials int32
+	proxy.server.Tr.Dial = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("dialed upstream")
+	}
+	conn, _, status := connectProxy(t, addr, "upstream.test:80", "")
+	conn.Close()
+	if status == 200 {
+		t.Error("Expected the CONNECT rejected offline")
+	}
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Errorf("Expected no upstream dials offline, got %d", n)
+	}
+}
+
+// replaceResponder replaces the response body.
+type replaceResponder struct {
+	body string
+}
+
+func (er *replaceResponder) Response(req *http.Request, resp *http.Response) *http.Response {
+	resp.Body.Close()
+	resp.Body = &Mutable{}
+	resp.Body.(*Mutable).WriteString(er.body)
+	return resp
+}
+
+func TestTransformedContentLength(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the original content"))
+	}))
+	defer upstream.Close()
+	proxy, addr := startTestProxy(t, Options{})
+	defer proxy.Close()
+	proxy.AddResponder(&replaceResponder{"short"})
+
+	resp, err := proxyClient(addr, nil).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "short" || resp.ContentLength != 5 {
+		t.Errorf("Expected the replaced body, got %q %d %v", body, resp.ContentLength, err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"image"
+	"image/color"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// hasAlpha returns true if any pixel of img isn't fully opaque.
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type colorCount struct {
+	c [4]uint8 // Non-premultiplied RGBA.
+	n int
+}
+
+// quantize returns img with a palette of at most 256 colors, keeping the alpha.
+// Images with few colors keep them exactly, otherwise the palette is chosen by median cut.
+// It doesn't dither, which would compress worse.
+func quantize(img image.Image) *image.Paletted {
+	src := imaging.Clone(img)
+	hist := make(map[[4]uint8]int)
+	for i := 0; i < len(src.Pix); i += 4 {
+		var c [4]uint8
+		if src.Pix[i+3] != 0 { // All fully transparent pixels are the same.
+			copy(c[:], src.Pix[i:i+4])
+		}
+		hist[c]++
+	}
+	var palette color.Palette
+	if _, ok := hist[[4]uint8{}]; ok {
+		palette = append(palette, color.NRGBA{})
+		delete(hist, [4]uint8{})
+	}
+	colors := make([]colorCount, 0, len(hist))
+	for c, n := range hist {
+		colors = append(colors, colorCount{c, n})
+	}
+	for _, box := range medianCut(colors, 256-len(palette)) {
+		var sum [4]int
+		total := 0
+		for _, cc := range box {
+			for ch := range sum {
+				sum[ch] += int(cc.c[ch]) * cc.n
+			}
+			total += cc.n
+		}
+		palette = append(palette, color.NRGBA{
+			uint8((sum[0] + total/2) / total), uint8((sum[1] + total/2) / total),
+			uint8((sum[2] + total/2) / total), uint8((sum[3] + total/2) / total),
+		})
+	}
+
+	dst := image.NewPaletted(src.Rect, palette)
+	cache := make(map[[4]uint8]uint8, len(palette))
+	for i, j := 0, 0; i < len(src.Pix); i, j = i+4, j+1 {
+		var c [4]uint8
+		if src.Pix[i+3] != 0 {
+			copy(c[:], src.Pix[i:i+4])
+		}
+		index, ok := cache[c]
+		if !ok {
+			index = nearestColor(palette, c)
+			cache[c] = index
+		}
+		dst.Pix[j] = index
+	}
+	return dst
+}
+
+// colorBox is a box of colors for medianCut, with its widest channel.
+type colorBox struct {
+	colors []colorCount
+	ch     int
+	width  int
+}
+
+func newColorBox(colors []colorCount) colorBox {
+	box := colorBox{colors: colors}
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := colors[0].c[ch], colors[0].c[ch]
+		for _, cc := range colors[1:] {
+			if cc.c[ch] < lo {
+				lo = cc.c[ch]
+			} else if cc.c[ch] > hi {
+				hi = cc.c[ch]
+			}
+		}
+		if w := int(hi) - int(lo); w > box.width {
+			box.ch, box.width = ch, w
+		}
+	}
+	return box
+}
+
+// medianCut splits the colors into at most n boxes of similar colors.
+func medianCut(colors []colorCount, n int) [][]colorCount {
+	if len(colors) == 0 {
+		return nil
+	}
+	boxes := []colorBox{newColorBox(colors)}
+	for len(boxes) < n {
+		// Split the widest box.
+		best := -1
+		for i, box := range boxes {
+			if box.width > 0 && (best == -1 || box.width > boxes[best].width) {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box.colors, func(i, j int) bool { return box.colors[i].c[box.ch] < box.colors[j].c[box.ch] })
+		total := 0
+		for _, cc := range box.colors {
+			total += cc.n
+		}
+		// Split at the median pixel, leaving at least a color on each side.
+		split, count := 1, box.colors[0].n
+		for split < len(box.colors)-1 && count*2 < total {
+			count += box.colors[split].n
+			split++
+		}
+		boxes[best] = newColorBox(box.colors[:split])
+		boxes = append(boxes, newColorBox(box.colors[split:]))
+	}
+	result := make([][]colorCount, len(boxes))
+	for i, box := range boxes {
+		result[i] = box.colors
+	}
+	return result
+}
+
+// nearestColor returns the index of the palette color closest to c.
+func nearestColor(palette color.Palette, c [4]uint8) uint8 {
+	best, bestDist := 0, -1
+	for i, pc := range palette {
+		p := pc.(color.NRGBA)
+		dist := 0
+		for ch, v := range [4]uint8{p.R, p.G, p.B, p.A} {
+			d := int(v) - int(c[ch])
+			dist += d * d
+		}
+		if bestDist == -1 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return uint8(best)
+}
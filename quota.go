@@ -0,0 +1,424 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/tdewolff/parse/html"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// QuotaAction is what happens to a client which used up its data quota.
+type QuotaAction int32
+
+const (
+	QuotaBlock QuotaAction = iota // Refuse requests with a page explaining the quota.
+	QuotaSave                     // Force the aggressive data savings, see RequestInfo.Savings
+	QuotaWarn                     // Allow, with a banner on HTML pages.
+)
+
+func (action QuotaAction) String() string {
+	switch action {
+	case QuotaBlock:
+		return "block"
+	case QuotaSave:
+		return "save"
+	case QuotaWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("QuotaAction(%d)", int32(action))
+}
+
+// ParseQuotaAction parses block, save or warn.
+func ParseQuotaAction(s string) (QuotaAction, error) {
+	for _, action := range []QuotaAction{QuotaBlock, QuotaSave, QuotaWarn} {
+		if strings.EqualFold(s, action.String()) {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quota action %q, expected block, save or warn", s)
+}
+
+// Quota is a data quota in bytes, 0 for unlimited.
+// Days and months are in local time.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+func (q Quota) enabled() bool {
+	return q.Daily > 0 || q.Monthly > 0
+}
+
+// Quotas are the data quotas, counted as the bytes sent to each client,
+// after compression and image shrinking, including CONNECT tunnels.
+type Quotas struct {
+	PerClient Quota            // Each client, by authenticated user, or by IP without auth.
+	Clients   map[string]Quota // Specific clients by user or IP, instead of PerClient.
+	Action    QuotaAction      // What happens when a quota is used up.
+	File      string           // JSON file to persist the usage across restarts, empty for memory only.
+}
+
+// Copy performs a readonly copy.
+func (quotas *Quotas) Copy() Quotas {
+	newquotas := *quotas
+	if quotas.Clients != nil {
+		newquotas.Clients = make(map[string]Quota, len(quotas.Clients))
+		for k, v := range quotas.Clients {
+			newquotas.Clients[k] = v
+		}
+	}
+	return newquotas
+}
+
+func (quotas *Quotas) quotaFor(client string) Quota {
+	if q, ok := quotas.Clients[client]; ok {
+		return q
+	}
+	return quotas.PerClient
+}
+
+// QuotaUsage is the data used by a client.
+type QuotaUsage struct {
+	Client     string
+	Day        string // 2006-01-02
+	DayBytes   int64
+	Month      string // 2006-01
+	MonthBytes int64
+	Quota      Quota
+	Exceeded   bool
+}
+
+// usage is the persisted part of QuotaUsage.
+type usage struct {
+	Day        string
+	DayBytes   int64
+	Month      string
+	MonthBytes int64
+}
+
+// roll starts a new day or month.
+func (u *usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+}
+
+func (u *usage) exceeded(q Quota) bool {
+	return (q.Daily > 0 && u.DayBytes >= q.Daily) || (q.Monthly > 0 && u.MonthBytes >= q.Monthly)
+}
+
+// quotaSaveDelay is how long after a change the usage is saved to the file.
+const quotaSaveDelay = 30 * time.Second
+
+// quotaStore accounts the data used by each client for Quotas.
+type quotaStore struct {
+	mx     sync.Mutex
+	quotas Quotas
+	usage  map[string]*usage
+	saving bool // A save is scheduled.
+}
+
+func (qs *quotaStore) configure(quotas Quotas) error {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	loadFile := quotas.File != "" && quotas.File != qs.quotas.File
+	qs.quotas = quotas
+	if qs.usage == nil {
+		qs.usage = make(map[string]*usage)
+	}
+	if loadFile {
+		data, err := ioutil.ReadFile(quotas.File)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		loaded := make(map[string]*usage)
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return fmt.Errorf("quota file %s: %w", quotas.File, err)
+		}
+		qs.usage = loaded
+	}
+	return nil
+}
+
+func (qs *quotaStore) enabled() bool {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	return qs.quotas.PerClient.enabled() || len(qs.quotas.Clients) != 0
+}
+
+// add accounts n bytes sent to the client.
+func (qs *quotaStore) add(client string, n int64, now time.Time) {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	u := qs.usage[client]
+	if u == nil {
+		u = &usage{}
+		qs.usage[client] = u
+	}
+	u.roll(now)
+	u.DayBytes += n
+	u.MonthBytes += n
+	if qs.quotas.File != "" && !qs.saving {
+		qs.saving = true
+		time.AfterFunc(quotaSaveDelay, func() {
+			if err := qs.save(); err != nil {
+				log.Printf("Error saving quota usage: %s", err)
+			}
+		})
+	}
+}
+
+// exceeded returns the action if the client used up its quota.
+func (qs *quotaStore) exceeded(client string, now time.Time) (QuotaAction, *QuotaUsage) {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	q := qs.quotas.quotaFor(client)
+	u := qs.usage[client]
+	if !q.enabled() || u == nil {
+		return 0, nil
+	}
+	u.roll(now)
+	if !u.exceeded(q) {
+		return 0, nil
+	}
+	return qs.quotas.Action, &QuotaUsage{client, u.Day, u.DayBytes, u.Month, u.MonthBytes, q, true}
+}
+
+// list returns the usage of all the clients, by client.
+func (qs *quotaStore) list(now time.Time) []QuotaUsage {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	list := make([]QuotaUsage, 0, len(qs.usage))
+	for client, u := range qs.usage {
+		u.roll(now)
+		q := qs.quotas.quotaFor(client)
+		list = append(list, QuotaUsage{client, u.Day, u.DayBytes, u.Month, u.MonthBytes, q, u.exceeded(q)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// reset forgets the usage of the client, or of all clients if empty.
+// Returns false if the client has no usage.
+func (qs *quotaStore) reset(client string) bool {
+	qs.mx.Lock()
+	defer qs.mx.Unlock()
+	if client == "" {
+		qs.usage = make(map[string]*usage)
+		return true
+	}
+	if _, ok := qs.usage[client]; !ok {
+		return false
+	}
+	delete(qs.usage, client)
+	return true
+}
+
+// save writes the usage to the file, if any.
+func (qs *quotaStore) save() error {
+	qs.mx.Lock()
+	qs.saving = false
+	fp := qs.quotas.File
+	data, err := json.Marshal(qs.usage)
+	qs.mx.Unlock()
+	if fp == "" || err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fp), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// quotaAccount counts the bytes written to a client connection.
+type quotaAccount struct {
+	store  *quotaStore
+	client string
+}
+
+func (acct *quotaAccount) add(n int) {
+	acct.store.add(acct.client, int64(n), time.Now())
+}
+
+// account sets the quota account of the bytes sent to the client.
+func (proxy *Proxy) account(rd *reqData) {
+	if rd.conn != nil {
+		var acct *quotaAccount
+		if proxy.quotas.enabled() {
+			acct = &quotaAccount{&proxy.quotas, rd.clientKey()}
+		}
+		rd.conn.setAccount(acct)
+	}
+}
+
+// QuotaUsage returns the data used by each client, see Options.Quotas
+func (proxy *Proxy) QuotaUsage() []QuotaUsage {
+	return proxy.quotas.list(time.Now())
+}
+
+// ResetQuotaUsage resets the data used by the client, or by all clients if empty.
+// Returns false if the client has no usage.
+func (proxy *Proxy) ResetQuotaUsage(client string) bool {
+	found := proxy.quotas.reset(client)
+	if err := proxy.quotas.save(); err != nil {
+		log.Printf("Error saving quota usage: %s", err)
+	}
+	return found
+}
+
+// quotaResponse is the response for clients blocked by QuotaBlock.
+func quotaResponse(req *http.Request, u *QuotaUsage) *http.Response {
+	return newHTMLResponse(req, http.StatusTooManyRequests, "Quota Exceeded", quotaTemplate, quotaData(u))
+}
+
+// quotaData formats the usage for the templates.
+func quotaData(u *QuotaUsage) interface{} {
+	format := func(used, quota int64) string {
+		if quota <= 0 {
+			return ""
+		}
+		return humanize.IBytes(uint64(used)) + " of " + humanize.IBytes(uint64(quota))
+	}
+	return struct {
+		Client  string
+		Daily   string
+		Monthly string
+	}{u.Client, format(u.DayBytes, u.Quota.Daily), format(u.MonthBytes, u.Quota.Monthly)}
+}
+
+// bannerTransform is a StreamTransform which inserts the banner at the start of the HTML body.
+func bannerTransform(banner []byte) StreamTransform {
+	return func(w io.Writer, r io.Reader) error {
+		lex := html.NewLexer(r)
+		inBody, done := false, false
+		for {
+			tt, data := lex.Next()
+			if tt == html.ErrorToken {
+				if lex.Err() != io.EOF {
+					return lex.Err()
+				}
+				return nil
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			if done {
+				continue
+			}
+			switch tt {
+			case html.StartTagToken:
+				inBody = bytes.EqualFold(lex.Text(), []byte("body"))
+			case html.StartTagCloseToken: // the > in <body>
+				if inBody {
+					if _, err := w.Write(banner); err != nil {
+						return err
+					}
+					done = true
+				}
+			}
+		}
+	}
+}
+
+// quotaBanner returns the banner for clients warned by QuotaWarn.
+func quotaBanner(u *QuotaUsage) []byte {
+	buf := &bytes.Buffer{}
+	if err := quotaBannerTemplate.Execute(buf, quotaData(u)); err != nil {
+		log.Printf("Error in %s template: %s", quotaBannerTemplate.Name(), err)
+	}
+	return buf.Bytes()
+}
+
+// serveQuotaAPI serves the quota API to direct requests from the local host with the admin secret:
+// GET /quota for the usage as JSON, POST /quota/reset?client=x to reset a client, or all without client.
+func (proxy *Proxy) serveQuotaAPI(w http.ResponseWriter, req *http.Request) {
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "The quota API is only available from the proxy host", http.StatusForbidden)
+		return
+	}
+	if !proxy.isAdmin(req) {
+		http.Error(w, "The quota API requires the admin secret", http.StatusForbidden)
+		return
+	}
+	switch req.URL.Path {
+	case "/quota":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(proxy.QuotaUsage())
+	case "/quota/reset":
+		if req.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		client := req.FormValue("client")
+		if !proxy.ResetQuotaUsage(client) {
+			http.Error(w, "No usage for client "+client, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+var quotaTemplate = template.Must(template.New("quota").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Data quota used up</title></head>
+<body>
+<h1>Data quota used up</h1>
+<p>The proxy did not load this page because <b>{{.Client}}</b> used up its data quota:</p>
+<ul>
+{{with .Daily}}<li>Today: {{.}}</li>{{end}}
+{{with .Monthly}}<li>This month: {{.}}</li>{{end}}
+</ul>
+<p>The quota resets at the start of the next day or month, or the proxy administrator can reset it.</p>
+</body></html>
+`))
+
+var quotaBannerTemplate = template.Must(template.New("quotaBanner").Parse(`<div data-from-smallprox=true style="all:initial;display:block;padding:4px 8px;background:#fc0;color:#000;font:14px sans-serif">` +
+	`Data quota used up{{with .Daily}}, today: {{.}}{{end}}{{with .Monthly}}, this month: {{.}}{{end}}.</div>`))
@@ -0,0 +1,171 @@
+package smallprox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallprox-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	quotas := Quotas{
+		PerClient: Quota{Daily: 100},
+		Clients:   map[string]Quota{"bob": {Monthly: 150}},
+		Action:    QuotaWarn,
+		File:      filepath.Join(dir, "quota.json"),
+	}
+	qs := &quotaStore{}
+	if err := qs.configure(quotas); err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2019, 7, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+
+	qs.add("1.2.3.4", 99, day1)
+	if _, u := qs.exceeded("1.2.3.4", day1); u != nil {
+		t.Error("Expected under the daily quota")
+	}
+	qs.add("1.2.3.4", 1, day1)
+	if action, u := qs.exceeded("1.2.3.4", day1); u == nil || action != QuotaWarn {
+		t.Error("Expected the daily quota used up")
+	}
+	if _, u := qs.exceeded("1.2.3.4", day2); u != nil {
+		t.Error("Expected the daily quota reset the next day")
+	}
+
+	qs.add("bob", 100, day1)
+	qs.add("bob", 100, day2)
+	if _, u := qs.exceeded("bob", day2); u == nil || u.MonthBytes != 200 || u.DayBytes != 100 {
+		t.Errorf("Expected bob's monthly quota used up, got %+v", u)
+	}
+	if err := qs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &quotaStore{}
+	if err := loaded.configure(quotas); err != nil {
+		t.Fatal(err)
+	}
+	list := loaded.list(day2)
+	if len(list) != 2 || list[0].Client != "1.2.3.4" || list[1].Client != "bob" || !list[1].Exceeded {
+		t.Errorf("Unexpected usage after loading: %+v", list)
+	}
+	if !loaded.reset("bob") || loaded.reset("bob") {
+		t.Error("Expected to reset bob once")
+	}
+	if _, u := loaded.exceeded("bob", day2); u != nil {
+		t.Error("Expected bob's usage reset")
+	}
+
+	if _, err := ParseQuotaAction("Save"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseQuotaAction("throttle"); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+}
+
+func TestQuotaBanner(t *testing.T) {
+	banner := quotaBanner(&QuotaUsage{Client: "bob", DayBytes: 2048, Quota: Quota{Daily: 1024}})
+	if !bytes.Contains(banner, []byte("2.0 KiB of 1.0 KiB")) {
+		t.Errorf("Unexpected banner: %s", banner)
+	}
+	for _, x := range []struct{ input, expect string }{
+		{`<html><body class="x">hi</body></html>`, `<html><body class="x">[banner]hi</body></html>`},
+		{`<p>no body</p>`, `<p>no body</p>`},
+		{`<bodyx><body>a<body>b`, `<bodyx><body>[banner]a<body>b`},
+	} {
+		out := &bytes.Buffer{}
+		if err := bannerTransform([]byte("[banner]"))(out, strings.NewReader(x.input)); err != nil {
+			t.Error(err)
+		}
+		if out.String() != x.expect {
+			t.Errorf("Expected %q, got %q", x.expect, out.String())
+		}
+	}
+}
+
+func TestQuotaAPI(t *testing.T) {
+	proxy, addr := startTestProxy(t, Options{AdminSecret: "s3cret", Quotas: Quotas{PerClient: Quota{Daily: 1 << 20}}})
+	defer proxy.Close()
+	proxy.quotas.add("1.2.3.4", 100, time.Now())
+	reset := func(client *http.Client, secret string) int {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/quota/reset?client=1.2.3.4", nil)
+		if secret != "" {
+			req.Header.Set(AdminSecretHeader, secret)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	hasUsage := func() bool {
+		for _, u := range proxy.QuotaUsage() {
+			if u.Client == "1.2.3.4" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Through the proxy, to the proxy itself.
+	if status := reset(proxyClient(addr, nil), "s3cret"); status == http.StatusNoContent || !hasUsage() {
+		t.Errorf("Expected the quota API refused through the proxy, got %d", status)
+	}
+	if conn, err := proxy.dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Expected the proxy to refuse to dial itself")
+	}
+	direct := &http.Client{Transport: &http.Transport{}}
+	if status := reset(direct, ""); status != http.StatusForbidden || !hasUsage() {
+		t.Errorf("Expected 403 without the admin secret, got %d", status)
+	}
+	if status := reset(direct, "wrong"); status != http.StatusForbidden || !hasUsage() {
+		t.Errorf("Expected 403 with the wrong admin secret, got %d", status)
+	}
+	if status := reset(direct, "s3cret"); status != http.StatusNoContent || hasUsage() {
+		t.Errorf("Expected the usage reset with the admin secret, got %d", status)
+	}
+}
+
+func TestQuotaUserSpelling(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	proxy, addr := startTestProxy(t, Options{Auth: "bob:pw", Quotas: Quotas{PerClient: Quota{Daily: 10}}})
+	defer proxy.Close()
+
+	get := func(user string) int {
+		resp, err := proxyClient(addr, url.UserPassword(user, "pw")).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("bob"); status != 200 {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if status := get("BOB"); status != http.StatusTooManyRequests {
+		t.Errorf("Expected the quota used up by bob to apply to BOB, got %d", status)
+	}
+	if list := proxy.QuotaUsage(); len(list) != 1 || list[0].Client != "bob" {
+		t.Errorf("Expected the usage of bob only, got %+v", list)
+	}
+}
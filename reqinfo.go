@@ -0,0 +1,68 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// RequestInfo is information about the client connection a request came in on.
+// Requesters and Responders can get it from req.Context() using RequestInfoFromContext.
+// Do not modify it, each request gets its own copy.
+type RequestInfo struct {
+	ConnID      int64  // Unique per client connection; requests within a CONNECT share it.
+	RequestID   int64  // Unique per request.
+	ClientAddr  string // The client's remote address, host:port
+	User        string // The authenticated proxy user, or empty if no auth.
+	ConnectHost string // The CONNECT target host:port, or empty if not within a CONNECT.
+	MITM        bool   // True if the request is being man-in-the-middled from a CONNECT.
+	TLS         bool   // True if the client connection is TLS, as in HTTPS MITM.
+	Savings     bool   // True if the client must get the aggressive data savings, see QuotaSave.
+}
+
+// WithinCONNECT returns true if the request came through a CONNECT tunnel.
+func (info *RequestInfo) WithinCONNECT() bool {
+	return info.ConnectHost != ""
+}
+
+// clientKey identifies the client, the user or IP.
+func (info *RequestInfo) clientKey() string {
+	if info.User != "" {
+		return info.User
+	}
+	if host, _, err := net.SplitHostPort(info.ClientAddr); err == nil {
+		return host
+	}
+	return info.ClientAddr
+}
+
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo for the request, or nil if not available.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+type connIDKey struct{}
+
+func connIDFromContext(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(int64)
+	return id, ok
+}
+
+// savingsFor returns true if the request must get the aggressive data savings.
+func savingsFor(req *http.Request) bool {
+	info := RequestInfoFromContext(req.Context())
+	return info != nil && info.Savings
+}
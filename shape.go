@@ -0,0 +1,254 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimits is bandwidth shaping, in bytes per second, 0 for unlimited.
+// Each applies separately to the bytes received from upstream and the bytes sent to clients,
+// a transfer is limited by all that apply.
+type RateLimits struct {
+	Global    int64            // All clients together.
+	PerClient int64            // Each client, by authenticated user, or by IP without auth.
+	Clients   map[string]int64 // Specific clients by user or IP, instead of PerClient.
+	Hosts     []HostRateLimit  // The first matching rule applies, its hosts share the rate.
+}
+
+// HostRateLimit is the rate limit for destination hosts.
+type HostRateLimit struct {
+	Hosts []string // Host names, "*.example.com" or ".example.com" also match subdomains.
+	Rate  int64    // Bytes per second.
+}
+
+// Copy performs a readonly copy.
+func (limits *RateLimits) Copy() RateLimits {
+	newlimits := *limits
+	if limits.Clients != nil {
+		newlimits.Clients = make(map[string]int64, len(limits.Clients))
+		for k, v := range limits.Clients {
+			newlimits.Clients[k] = v
+		}
+	}
+	newlimits.Hosts = append([]HostRateLimit(nil), limits.Hosts...)
+	return newlimits
+}
+
+func (limits *RateLimits) enabled() bool {
+	return limits.Global > 0 || limits.PerClient > 0 || len(limits.Clients) != 0 || len(limits.Hosts) != 0
+}
+
+// Directions of transfers.
+const (
+	fromUpstream = "u"
+	toClient     = "c"
+)
+
+// shapeChunk is the most sent at once, so concurrent transfers interleave.
+const shapeChunk = 16 << 10
+
+// tokenBucket is a token bucket rate limiter, a token per byte.
+type tokenBucket struct {
+	mx     sync.Mutex
+	rate   float64 // Per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate)
+	if burst < shapeChunk {
+		burst = shapeChunk
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long to wait for them.
+// Reservations beyond the available tokens go into debt, so waiters are served in order.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// unreserve gives back n tokens of a reservation which wasn't used.
+func (b *tokenBucket) unreserve(n int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// idle returns true if the bucket is unused since before.
+func (b *tokenBucket) idle(before time.Time) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.last.Before(before)
+}
+
+// waitBuckets waits for n bytes from all the buckets.
+// If ctx is done first, the reservations are given back and the error of ctx is returned.
+func waitBuckets(ctx context.Context, buckets []*tokenBucket, n int) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		for _, b := range buckets {
+			b.unreserve(n)
+		}
+		return ctx.Err()
+	}
+}
+
+// shaper has the token buckets for RateLimits.
+type shaper struct {
+	mx        sync.Mutex
+	limits    RateLimits
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func (s *shaper) configure(limits RateLimits) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.limits = limits
+	s.buckets = nil // New rates.
+}
+
+// getBuckets returns the buckets for a transfer in the direction dir, for the client and destination host.
+// client is the authenticated user or IP.
+func (s *shaper) getBuckets(dir, client, host string) []*tokenBucket {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.limits.enabled() {
+		return nil
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		for key, b := range s.buckets {
+			if b.idle(now.Add(-time.Minute)) {
+				delete(s.buckets, key)
+			}
+		}
+	}
+	var buckets []*tokenBucket
+	add := func(key string, rate int64) {
+		if rate <= 0 {
+			return
+		}
+		key = dir + key
+		b := s.buckets[key]
+		if b == nil {
+			b = newTokenBucket(rate)
+			s.buckets[key] = b
+		}
+		buckets = append(buckets, b)
+	}
+	add("g", s.limits.Global)
+	if rate, ok := s.limits.Clients[client]; ok {
+		add("c:"+client, rate)
+	} else {
+		add("c:"+client, s.limits.PerClient)
+	}
+	for i, rule := range s.limits.Hosts {
+		matches := false
+		for _, pattern := range rule.Hosts {
+			if matchHostPattern(pattern, host) {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			add("h:"+strconv.Itoa(i), rule.Rate)
+			break
+		}
+	}
+	return buckets
+}
+
+// clientKey is the client for RateLimits, the user or IP.
+func (rd *reqData) clientKey() string {
+	return rd.info.clientKey()
+}
+
+// shape sets the rate limits of the bytes sent to the client, for the destination host.
+// In tunnels the upstream rate limits apply too, see shapeTunnel.
+func (proxy *Proxy) shape(rd *reqData, host string) {
+	if rd.conn != nil {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		buckets := proxy.shaper.getBuckets(toClient, rd.clientKey(), host)
+		if rd.tunnel {
+			buckets = append(buckets, proxy.shaper.getBuckets(fromUpstream, rd.clientKey(), host)...)
+		}
+		rd.conn.setShape(buckets)
+	}
+}
+
+// shapeTunnel shapes a CONNECT tunnel or HTTP MITM, whose upstream side doesn't go through roundTrip.
+// What the client is sent is what was received from upstream, so the client writes are limited by both.
+func (proxy *Proxy) shapeTunnel(rd *reqData, host string) {
+	rd.tunnel = true
+	proxy.shape(rd, host)
+}
+
+// shapedReader limits the rate of reads, until ctx is done.
+type shapedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if len(p) > shapeChunk {
+		p = p[:shapeChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := waitBuckets(r.ctx, r.buckets, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
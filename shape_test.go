@@ -0,0 +1,136 @@
+package smallprox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100 << 10) // 100 KiB/s
+	now := b.last
+	if d := b.reserve(100<<10, now); d != 0 {
+		t.Errorf("Expected the burst without waiting, got %v", d)
+	}
+	if d := b.reserve(50<<10, now); d != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", d)
+	}
+	if d := b.reserve(50<<10, now.Add(500*time.Millisecond)); d != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms after the debt, got %v", d)
+	}
+	if d := b.reserve(1, now.Add(time.Hour)); d != 0 {
+		t.Errorf("Expected refilled, got %v", d)
+	}
+}
+
+func TestShaperBuckets(t *testing.T) {
+	s := &shaper{}
+	if buckets := s.getBuckets(toClient, "1.2.3.4", "example.com"); buckets != nil {
+		t.Error("Expected no buckets when not configured")
+	}
+	s.configure(RateLimits{
+		Global:    1000,
+		PerClient: 100,
+		Clients:   map[string]int64{"bob": 0, "alice": 500},
+		Hosts:     []HostRateLimit{{Hosts: []string{".example.com"}, Rate: 10}},
+	})
+	for _, x := range []struct {
+		client, host string
+		rates        []float64
+	}{
+		{"1.2.3.4", "example.org", []float64{1000, 100}},
+		{"bob", "example.org", []float64{1000}},
+		{"alice", "www.example.com", []float64{1000, 500, 10}},
+	} {
+		buckets := s.getBuckets(toClient, x.client, x.host)
+		if len(buckets) != len(x.rates) {
+			t.Errorf("%s %s: expected %d buckets, got %d", x.client, x.host, len(x.rates), len(buckets))
+			continue
+		}
+		for i, b := range buckets {
+			if b.rate != x.rates[i] {
+				t.Errorf("%s %s: expected rate %v, got %v", x.client, x.host, x.rates[i], b.rate)
+			}
+		}
+	}
+	a := s.getBuckets(toClient, "1.2.3.4", "")
+	b := s.getBuckets(toClient, "1.2.3.4", "")
+	c := s.getBuckets(fromUpstream, "1.2.3.4", "")
+	if a[1] != b[1] || a[1] == c[1] {
+		t.Error("Expected the same bucket per client and direction")
+	}
+}
+
+func TestWaitBucketsCanceled(t *testing.T) {
+	b := newTokenBucket(shapeChunk) // The burst is a second.
+	buckets := []*tokenBucket{b}
+	if err := waitBuckets(context.Background(), buckets, shapeChunk); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := waitBuckets(ctx, buckets, 10*shapeChunk); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to stop waiting when done, waited %v", elapsed)
+	}
+	// The canceled reservation was given back, only the first is owed.
+	if d := b.reserve(0, time.Now()); d > time.Second {
+		t.Errorf("Expected the reservation given back, would wait %v", d)
+	}
+}
+
+func TestShapeTunnel(t *testing.T) {
+	content := strings.Repeat("x", 100<<10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+	used := func(proxy *Proxy) float64 {
+		b := proxy.shaper.getBuckets(fromUpstream, "127.0.0.1", "upstream.test")[0]
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		return b.burst - b.tokens
+	}
+
+	for _, tc := range []struct {
+		name        string
+		connectMITM bool
+		host        string
+	}{
+		{"raw tunnel", false, "upstream.test:443"},
+		{"HTTP MITM", true, "upstream.test:80"},
+	} {
+		proxy, addr := startTestProxy(t, Options{ConnectMITM: tc.connectMITM, RateLimits: RateLimits{Global: 1 << 20}})
+		proxy.server.Tr.Dial = func(network, _ string) (net.Conn, error) {
+			return net.Dial(network, upstream.Listener.Addr().String())
+		}
+		conn, r, status := connectProxy(t, addr, tc.host, "")
+		if status != 200 {
+			t.Fatalf("%s: expected CONNECT 200, got %d", tc.name, status)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		if len(body) != len(content) {
+			t.Errorf("%s: expected %d bytes, got %d", tc.name, len(content), len(body))
+		}
+		if n := used(proxy); n < float64(len(content)/2) {
+			t.Errorf("%s: expected the upstream rate limit to apply, %v used", tc.name, n)
+		}
+		proxy.Close()
+	}
+}
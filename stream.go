@@ -0,0 +1,91 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+)
+
+// StreamTransform transforms a body as it streams, reading from r and writing to w.
+// Writes reach the client as they are made, no need to buffer the whole body.
+type StreamTransform func(w io.Writer, r io.Reader) error
+
+// StreamResponder is a Responder which transforms the response body as it streams,
+// so the first bytes reach the client before the whole body is downloaded.
+// Response is typically implemented using ApplyStream(resp, er.StreamResponse(req, resp))
+type StreamResponder interface {
+	Responder
+	// StreamResponse returns the transform for the response body, or nil to leave it as is.
+	// The headers may be changed here, but the body must not be consumed.
+	StreamResponse(req *http.Request, resp *http.Response) StreamTransform
+}
+
+// ApplyStream wraps resp.Body with the transform, if not nil.
+// The transform runs as the new body is read, the length is no longer known.
+func ApplyStream(resp *http.Response, transform StreamTransform) *http.Response {
+	if transform == nil {
+		return resp
+	}
+	resp.Body = newStreamBody(resp.Body, transform)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	transformed(resp.Header)
+	return resp
+}
+
+// streamBody is the body returned by newStreamBody.
+type streamBody struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (body *streamBody) Close() error {
+	body.PipeReader.Close() // Stops the transform.
+	return body.src.Close()
+}
+
+// newStreamBody returns a body which is src transformed by transform, in a goroutine.
+func newStreamBody(src io.ReadCloser, transform StreamTransform) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriterSize(pw, 32*1024)
+		err := transform(bw, &flushReader{r: src, flush: bw.Flush})
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			log.Printf("Error transforming response: %s", err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &streamBody{PipeReader: pr, src: src}
+}
+
+// flushReader calls flush before each read from r,
+// so anything written so far is sent while waiting for more input.
+type flushReader struct {
+	r     io.Reader
+	flush func() error
+	dirty bool
+}
+
+func (fr *flushReader) Read(p []byte) (int, error) {
+	if fr.dirty {
+		fr.dirty = false
+		if err := fr.flush(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := fr.r.Read(p)
+	if n > 0 {
+		fr.dirty = true // Something may be written based on it.
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+package smallprox
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyStream(t *testing.T) {
+	pr, pw := io.Pipe()
+	resp := &http.Response{Header: http.Header{"Content-Length": {"100"}, "Accept-Ranges": {"bytes"}}, ContentLength: 100, Body: pr}
+	resp = ApplyStream(resp, func(w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("Expected unknown length")
+	}
+	if resp.Header.Get("Accept-Ranges") != "" {
+		t.Error("Expected Accept-Ranges removed")
+	}
+	go pw.Write([]byte("first"))
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 10)
+		n, _ := resp.Body.Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case x := <-got:
+		if x != "first" {
+			t.Errorf("Unexpected %q", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Data did not stream before the source finished")
+	}
+	resp.Body.Close()
+	if _, err := pw.Write([]byte("more")); err == nil {
+		t.Error("Expected the source to be closed")
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	input := strings.Repeat("<p>hello world</p>\n", 100)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/html"}},
+		Body:   ioutil.NopCloser(strings.NewReader(input)),
+	}
+	er := &CompressResponder{}
+	resp = er.Response(req, resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Error("Did not get the input back")
+	}
+}
+
+func TestPartialContent(t *testing.T) {
+	const part = "<p><script>alert(1)</script></p>"
+	compress := &CompressResponder{}
+	compress.SetEnabled(true)
+	noscript := &NoscriptResponder{}
+	noscript.SetEnabled(true)
+	images := &ImageShrinkResponder{}
+	images.SetEnabled(true)
+	for _, contentType := range []string{"text/html", "image/png"} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Range", "bytes=10-41")
+		req.Header.Set("Accept-Encoding", "gzip")
+		header := http.Header{
+			"Content-Type":   {contentType},
+			"Content-Range":  {"bytes 10-41/100"},
+			"Content-Length": {"32"},
+			"Accept-Ranges":  {"bytes"},
+		}
+		resp := &http.Response{StatusCode: http.StatusPartialContent, Header: header, ContentLength: 32,
+			Body: ioutil.NopCloser(strings.NewReader(part))}
+		if err := decodeResponse(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, er := range []Responder{noscript, images, compress} {
+			resp = er.Response(req, resp)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != part || resp.StatusCode != http.StatusPartialContent || resp.ContentLength != 32 ||
+			resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: partial content was changed: %d %v %q", contentType, resp.StatusCode, resp.Header, body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp := &http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body: ioutil.NopCloser(strings.NewReader("partial"))}
+	if err := decodeResponse(req, resp); err == nil || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("Expected encoded partial content to be left as is")
+	}
+}
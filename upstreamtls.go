@@ -0,0 +1,184 @@
+// Copyright (C) 2019 Christopher E. Miller
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package smallprox
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+
+	"golang.org/x/exp/errors"
+	"golang.org/x/exp/errors/fmt"
+)
+
+// UpstreamTLSRule is how to verify the TLS certificates of matching upstream hosts.
+type UpstreamTLSRule struct {
+	Hosts      []string       // Host names, "*.example.com" or ".example.com" also match subdomains.
+	RootCAs    *x509.CertPool // Verify against these CAs instead of the system CAs, if set.
+	Pins       []string       // Base64 SHA-256 hashes of the SPKI (see SPKIPin), one must be in the verified chain, if set.
+	SkipVerify bool           // Don't verify the certificates, other than Pins, which then must match the leaf.
+}
+
+// Matches returns true if the rule applies to host.
+func (rule *UpstreamTLSRule) Matches(host string) bool {
+	for _, pattern := range rule.Hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[1:]
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return len(host) > len(pattern) && strings.EqualFold(host[len(host)-len(pattern):], pattern)
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// UpstreamTLSError is the error when an upstream's certificate is rejected.
+type UpstreamTLSError struct {
+	Host string
+	Err  error
+}
+
+func (err *UpstreamTLSError) Error() string {
+	return fmt.Sprintf("upstream certificate for %s rejected: %s", err.Host, err.Err)
+}
+
+func (err *UpstreamTLSError) Unwrap() error {
+	return err.Err
+}
+
+// SPKIPin returns the base64 SHA-256 hash of the certificate's public key info, for UpstreamTLSRule.Pins
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (proxy *Proxy) getUpstreamTLSRule(host string) *UpstreamTLSRule {
+	proxy.mx.RLock()
+	defer proxy.mx.RUnlock()
+	for i := range proxy.opts.UpstreamTLS {
+		rule := &proxy.opts.UpstreamTLS[i]
+		if rule.Matches(host) {
+			return rule
+		}
+	}
+	if proxy.opts.InsecureSkipVerify {
+		return &UpstreamTLSRule{SkipVerify: true}
+	}
+	return nil
+}
+
+// verifyConnection is the upstream tls.Config VerifyConnection,
+// only used if the transport handles TLS itself, see dialTLSContext
+func (proxy *Proxy) verifyConnection(cs tls.ConnectionState) error {
+	return proxy.verifyUpstreamCerts(cs.ServerName, cs.PeerCertificates)
+}
+
+// dialTLSContext dials a TLS upstream, verified using the UpstreamTLS rules.
+func (proxy *Proxy) dialTLSContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := proxy.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, proxy.upstreamTLSConfig(addr))
+	handshaken := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // Stops the handshake.
+		case <-handshaken:
+		}
+	}()
+	err = tconn.Handshake()
+	close(handshaken)
+	if err == nil {
+		err = ctx.Err() // The connection may have been closed.
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// upstreamTLSConfig returns the TLS config for the upstream addr, host:port
+func (proxy *Proxy) upstreamTLSConfig(addr string) *tls.Config {
+	serverName := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"http/1.1"},
+		InsecureSkipVerify: true, // Verified by VerifyConnection.
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return proxy.verifyUpstreamCerts(serverName, cs.PeerCertificates)
+		},
+	}
+}
+
+// verifyUpstreamCerts verifies the certificates presented by the upstream serverName.
+// Returns an *UpstreamTLSError if rejected.
+func (proxy *Proxy) verifyUpstreamCerts(serverName string, certs []*x509.Certificate) error {
+	err := proxy.getUpstreamTLSRule(serverName).verify(serverName, certs)
+	if err != nil {
+		return &UpstreamTLSError{Host: serverName, Err: err}
+	}
+	return nil
+}
+
+// verify using the rule, or the defaults if rule is nil.
+func (rule *UpstreamTLSRule) verify(serverName string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificates")
+	}
+	if rule == nil {
+		rule = &UpstreamTLSRule{}
+	}
+	// Without verification, only the leaf is bound to the handshake;
+	// anyone can append a copy of the pinned certificate to their chain.
+	chains := [][]*x509.Certificate{certs[:1]}
+	if !rule.SkipVerify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		var err error
+		chains, err = certs[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: intermediates,
+			Roots:         rule.RootCAs,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(rule.Pins) != 0 {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := SPKIPin(cert)
+				for _, x := range rule.Pins {
+					if strings.TrimPrefix(x, "sha256/") == pin {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no certificate matches the pinned public keys")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package smallprox
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/errors"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamTLSRuleVerify(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTLS, err := signHost(ca, leafSpec{Hosts: []string{"lab.example"}, ValidFor: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for _, der := range leafTLS.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	var nilRule *UpstreamTLSRule
+	if err := nilRule.verify("lab.example", certs); err == nil {
+		t.Error("Expected the default rule to reject an unknown CA")
+	}
+	if err := (&UpstreamTLSRule{RootCAs: roots}).verify("lab.example", certs); err != nil {
+		t.Error(err)
+	}
+	if err := (&UpstreamTLSRule{RootCAs: roots}).verify("other.example", certs); err == nil {
+		t.Error("Expected a host name mismatch")
+	}
+	if err := (&UpstreamTLSRule{SkipVerify: true}).verify("other.example", certs); err != nil {
+		t.Error(err)
+	}
+	pin := SPKIPin(caCert)
+	if err := (&UpstreamTLSRule{RootCAs: roots, Pins: []string{"sha256/" + pin}}).verify("lab.example", certs); err != nil {
+		t.Error(err)
+	}
+	wrongPin := SPKIPin(&x509.Certificate{RawSubjectPublicKeyInfo: []byte("x")})
+	if err := (&UpstreamTLSRule{SkipVerify: true, Pins: []string{wrongPin}}).verify("lab.example", certs); err == nil {
+		t.Error("Expected a pin mismatch")
+	}
+	// Without verification, a pinned certificate appended to the chain doesn't count.
+	other, err := GenerateCA(CAOptions{KeyType: "ecdsa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTLS, err := signHost(other, leafSpec{Hosts: []string{"lab.example"}, ValidFor: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherLeaf, err := x509.ParseCertificate(otherTLS.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPin := SPKIPin(certs[0])
+	if err := (&UpstreamTLSRule{SkipVerify: true, Pins: []string{leafPin}}).verify("lab.example", certs); err != nil {
+		t.Error(err)
+	}
+	appended := []*x509.Certificate{otherLeaf, certs[0], caCert}
+	for _, pin := range []string{leafPin, SPKIPin(caCert)} {
+		if err := (&UpstreamTLSRule{SkipVerify: true, Pins: []string{pin}}).verify("lab.example", appended); err == nil {
+			t.Error("Expected a pin mismatch for an appended certificate")
+		}
+	}
+	if err := (&UpstreamTLSRule{RootCAs: roots, Pins: []string{leafPin}}).verify("lab.example", appended); err == nil {
+		t.Error("Expected the appended certificate to fail verification")
+	}
+
+	proxy := NewProxy(Options{UpstreamTLS: []UpstreamTLSRule{{Hosts: []string{".example"}, RootCAs: roots}}})
+	if err := proxy.verifyUpstreamCerts("lab.example", certs); err != nil {
+		t.Error(err)
+	}
+	err = proxy.verifyUpstreamCerts("lab.test", certs)
+	var tlsErr *UpstreamTLSError
+	if !errors.As(err, &tlsErr) || tlsErr.Host != "lab.test" {
+		t.Errorf("Expected an UpstreamTLSError, got %v", err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"strings"
 	"sync/atomic"
 )
@@ -83,6 +84,49 @@ func HasAnyHeaderValuePart(from []string, value string) bool {
 	return false
 }
 
+// canTransform returns true if a responder may change the response body.
+// Not for partial content, its Content-Range is of the upstream's representation,
+// nor if it still has a Content-Encoding, which wasn't decoded,
+// nor if the request or response Cache-Control has no-transform, nor if over the LimitBytesResponder limit.
+func canTransform(req *http.Request, resp *http.Response) bool {
+	if _, ok := resp.Body.(*passThroughBody); ok {
+		return false
+	}
+	return resp.StatusCode != http.StatusPartialContent && resp.Header.Get("Content-Encoding") == "" &&
+		!parseCacheControl(resp.Header["Cache-Control"]).has("no-transform") &&
+		!parseCacheControl(req.Header["Cache-Control"]).has("no-transform")
+}
+
+// transformed updates the header of a response whose body was changed by a responder.
+// The ETag is weakened, the content is equivalent but not byte for byte,
+// and headers about the original bytes are removed.
+func transformed(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	for _, name := range []string{"Accept-Ranges", "Content-Md5", "Digest", "Content-Digest", "Repr-Digest"} {
+		header.Del(name)
+	}
+}
+
+// addVary adds the request header names to the Vary of the response header, if not already there.
+func addVary(header http.Header, names ...string) {
+	for _, name := range names {
+		found := false
+		for _, x := range header["Vary"] {
+			for _, v := range strings.Split(x, ",") {
+				v = strings.TrimSpace(v)
+				if v == "*" || strings.EqualFold(v, name) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			header.Add("Vary", name)
+		}
+	}
+}
+
 func mustDecodeStringBase64(s string) []byte {
 	x, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -1,6 +1,9 @@
 package smallprox
 
 import (
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -33,3 +36,58 @@ var hasHeaderValuePartTests = [][]string{
 	[]string{",doggo", "dog", "f"},
 	[]string{" doggo", "dog", "f"},
 }
+
+func TestTransformHeaders(t *testing.T) {
+	compress := &CompressResponder{}
+	compress.SetEnabled(true)
+	newResp := func(cc string) (*http.Request, *http.Response) {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		header := http.Header{
+			"Content-Type":  {"text/html"},
+			"Etag":          {`"abc"`},
+			"Accept-Ranges": {"bytes"},
+			"Vary":          {"Cookie"},
+		}
+		if cc != "" {
+			header.Set("Cache-Control", cc)
+		}
+		body := strings.Repeat("<p>hello world</p>\n", 100)
+		return req, &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+
+	req, resp := newResp("max-age=60")
+	resp = compress.Response(req, resp)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("Expected compressed")
+	}
+	if etag := resp.Header.Get("ETag"); etag != `W/"abc"` {
+		t.Errorf("Expected a weak ETag, got %q", etag)
+	}
+	if resp.Header.Get("Accept-Ranges") != "" {
+		t.Error("Expected Accept-Ranges removed")
+	}
+	if vary := resp.Header["Vary"]; len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding added, got %q", vary)
+	}
+
+	req, resp = newResp("no-transform")
+	resp = compress.Response(req, resp)
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("ETag") != `"abc"` {
+		t.Error("Expected no-transform to be honored")
+	}
+
+	req, resp = newResp("")
+	req.Header.Set("Accept-Encoding", "identity")
+	resp = compress.Response(req, resp)
+	if resp.Header.Get("Content-Encoding") != "" || !HasAnyHeaderValuePart(resp.Header["Vary"], "Accept-Encoding") {
+		t.Error("Expected Vary: Accept-Encoding even if not compressed")
+	}
+
+	header := http.Header{"Vary": {"*"}, "Etag": {`W/"x"`}}
+	addVary(header, "Accept")
+	transformed(header)
+	if len(header["Vary"]) != 1 || header.Get("ETag") != `W/"x"` {
+		t.Errorf("Unexpected %v", header)
+	}
+}